@@ -0,0 +1,535 @@
+package base
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sync"
+	"time"
+)
+
+var (
+	ErrorUnknownCodec error = errors.New("Session data was not encoded with a known codec")
+	ErrorCorruptData  error = errors.New("Session data is corrupt")
+	ErrorNoValueCodec error = errors.New("Codec cannot encode individual values")
+)
+
+const (
+	// Ids of the built-in codecs.  Ids up to 15 are reserved for this package
+	CODEC_GOB    byte = 1
+	CODEC_JSON   byte = 2
+	CODEC_BINARY byte = 3
+)
+
+/*
+Codec serializes sessions for SessionHolders that store them.  The session's Values, Created time
+and user are encoded.  Other metadata is kept by the SessionHolder.
+
+Data is stored with the codec's Id as a prefix byte, so a SessionHolder can read sessions written
+with any registered codec.  This means you can switch codec without losing existing sessions: they
+are rewritten with the new codec the next time they are saved.
+*/
+type Codec interface {
+	// Id identifies the codec in stored data.  Must not be 0
+	Id() byte
+	Encode(session *Session) ([]byte, error)
+	Decode(data []byte, session *Session) error
+}
+
+var (
+	/*
+		GobCodec encodes sessions with encoding/gob.  Go types stored in session values must be
+		registered with gob.Register()
+	*/
+	GobCodec Codec = gobCodec{}
+	/*
+		JSONCodec encodes sessions as a JSON object, so they can be read by services not written in
+		Go.  Values come back as the types encoding/json decodes into an interface{}, so for example
+		numbers are always float64
+	*/
+	JSONCodec Codec = jsonCodec{}
+	/*
+		BinaryCodec is a compact binary encoding.  It supports nil, bool, int, int64, float64, string,
+		[]byte, time.Time, []string, []interface{} and map[string]interface{} values, and returns
+		them with the type they were stored as
+	*/
+	BinaryCodec Codec = binaryCodec{}
+)
+
+var codecs = struct {
+	sync.RWMutex
+	byId map[byte]Codec
+}{
+	byId: map[byte]Codec{
+		CODEC_GOB:    GobCodec,
+		CODEC_JSON:   JSONCodec,
+		CODEC_BINARY: BinaryCodec,
+	},
+}
+
+/*
+RegisterCodec makes a codec available to DecodeSession.  The built-in codecs are always registered
+*/
+func RegisterCodec(codec Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byId[codec.Id()] = codec
+}
+
+/*
+EncodeSession encodes session with codec, prefixed with the codec's Id
+*/
+func EncodeSession(codec Codec, session *Session) ([]byte, error) {
+	data, err := codec.Encode(session)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{codec.Id()}, data...), nil
+}
+
+/*
+DecodeSession decodes data from EncodeSession into session, using the codec named by the prefix.
+Returns ErrorUnknownCodec if the prefix isn't the Id of a registered codec
+*/
+func DecodeSession(data []byte, session *Session) error {
+	if len(data) == 0 {
+		return ErrorUnknownCodec
+	}
+	codecs.RLock()
+	codec, ok := codecs.byId[data[0]]
+	codecs.RUnlock()
+	if !ok {
+		return ErrorUnknownCodec
+	}
+	if err := codec.Decode(data[1:], session); err != nil {
+		return err
+	}
+	if session.Values == nil {
+		session.Values = make(map[string]interface{})
+	}
+	return nil
+}
+
+/*
+ValueCodec is implemented by Codecs that can also encode individual session values, for
+SessionHolders that store each value separately.  The built-in codecs all implement it
+*/
+type ValueCodec interface {
+	Codec
+	EncodeValue(value interface{}) ([]byte, error)
+	DecodeValue(data []byte) (interface{}, error)
+}
+
+/*
+EncodeValue encodes a single session value with codec, prefixed with the codec's Id.  Returns
+ErrorNoValueCodec if the codec doesn't implement ValueCodec
+*/
+func EncodeValue(codec Codec, value interface{}) ([]byte, error) {
+	vc, ok := codec.(ValueCodec)
+	if !ok {
+		return nil, ErrorNoValueCodec
+	}
+	data, err := vc.EncodeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{codec.Id()}, data...), nil
+}
+
+/*
+DecodeValue decodes a value from EncodeValue, using the codec named by the prefix
+*/
+func DecodeValue(data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, ErrorUnknownCodec
+	}
+	codecs.RLock()
+	codec, ok := codecs.byId[data[0]]
+	codecs.RUnlock()
+	if !ok {
+		return nil, ErrorUnknownCodec
+	}
+	vc, ok := codec.(ValueCodec)
+	if !ok {
+		return nil, ErrorNoValueCodec
+	}
+	return vc.DecodeValue(data[1:])
+}
+
+// sessionRecord is the part of a session encoded by the gob and JSON codecs
+type sessionRecord struct {
+	Values    map[string]interface{} `json:"values"`
+	Created   time.Time              `json:"created"`
+	UserId    string                 `json:"user_id,omitempty"`
+	UserAgent string                 `json:"user_agent,omitempty"`
+	Version   int64                  `json:"version,omitempty"`
+}
+
+func newSessionRecord(session *Session) *sessionRecord {
+	return &sessionRecord{
+		Values:    session.Values,
+		Created:   session.Created,
+		UserId:    session.UserId,
+		UserAgent: session.UserAgent,
+		Version:   session.Version,
+	}
+}
+
+func (r *sessionRecord) apply(session *Session) {
+	session.Values = r.Values
+	session.Created = r.Created
+	session.UserId = r.UserId
+	session.UserAgent = r.UserAgent
+	session.Version = r.Version
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Id() byte {
+	return CODEC_GOB
+}
+
+func (gobCodec) Encode(session *Session) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(newSessionRecord(session)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Decode(data []byte, session *Session) error {
+	var r sessionRecord
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&r); err != nil {
+		return err
+	}
+	r.apply(session)
+	return nil
+}
+
+func (gobCodec) EncodeValue(value interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	// Encode a pointer to the interface so the decoder learns the concrete type
+	if err := gob.NewEncoder(&b).Encode(&value); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobCodec) DecodeValue(data []byte) (interface{}, error) {
+	var value interface{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value)
+	return value, err
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Id() byte {
+	return CODEC_JSON
+}
+
+func (jsonCodec) Encode(session *Session) ([]byte, error) {
+	return json.Marshal(newSessionRecord(session))
+}
+
+func (jsonCodec) Decode(data []byte, session *Session) error {
+	var r sessionRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	r.apply(session)
+	return nil
+}
+
+func (jsonCodec) EncodeValue(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) DecodeValue(data []byte) (interface{}, error) {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+// Type tags for values encoded by binaryCodec
+const (
+	binaryNil byte = iota
+	binaryFalse
+	binaryTrue
+	binaryInt
+	binaryInt64
+	binaryFloat64
+	binaryString
+	binaryBytes
+	binaryTime
+	binaryStrings
+	binaryList
+	binaryMap
+)
+
+/*
+binaryCodec writes the Created time, user Id, user agent, the values then the version.  The
+version is left out when it is 0, as it is in data written before sessions had versions.  Each value is a type
+tag followed by the value.  Integers are varints, and strings, byte slices, lists and maps are
+prefixed with their length as a uvarint
+*/
+type binaryCodec struct{}
+
+func (binaryCodec) Id() byte {
+	return CODEC_BINARY
+}
+
+func (binaryCodec) Encode(session *Session) ([]byte, error) {
+	var w binaryWriter
+	created, err := session.Created.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	w.bytes(created)
+	w.string(session.UserId)
+	w.string(session.UserAgent)
+	if err := w.value(session.Values); err != nil {
+		return nil, err
+	}
+	if session.Version != 0 {
+		w.varint(session.Version)
+	}
+	return w.Bytes(), nil
+}
+
+func (binaryCodec) Decode(data []byte, session *Session) (err error) {
+	r := binaryReader{Reader: bytes.NewReader(data)}
+	defer r.recover(&err)
+
+	if err := session.Created.UnmarshalBinary(r.bytes()); err != nil {
+		return err
+	}
+	session.UserId = r.string()
+	session.UserAgent = r.string()
+	values, ok := r.value().(map[string]interface{})
+	if !ok {
+		return ErrorCorruptData
+	}
+	session.Values = values
+	session.Version = 0
+	if r.Len() > 0 {
+		session.Version = r.varint()
+	}
+	return nil
+}
+
+func (binaryCodec) EncodeValue(value interface{}) ([]byte, error) {
+	var w binaryWriter
+	if err := w.value(value); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func (binaryCodec) DecodeValue(data []byte) (value interface{}, err error) {
+	r := binaryReader{Reader: bytes.NewReader(data)}
+	defer r.recover(&err)
+	return r.value(), nil
+}
+
+type binaryWriter struct {
+	bytes.Buffer
+}
+
+func (w *binaryWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (w *binaryWriter) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (w *binaryWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.Write(b)
+}
+
+func (w *binaryWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (w *binaryWriter) value(val interface{}) error {
+	switch val := val.(type) {
+	case nil:
+		w.WriteByte(binaryNil)
+	case bool:
+		if val {
+			w.WriteByte(binaryTrue)
+		} else {
+			w.WriteByte(binaryFalse)
+		}
+	case int:
+		w.WriteByte(binaryInt)
+		w.varint(int64(val))
+	case int64:
+		w.WriteByte(binaryInt64)
+		w.varint(val)
+	case float64:
+		w.WriteByte(binaryFloat64)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(val))
+		w.Write(b[:])
+	case string:
+		w.WriteByte(binaryString)
+		w.string(val)
+	case []byte:
+		w.WriteByte(binaryBytes)
+		w.bytes(val)
+	case time.Time:
+		w.WriteByte(binaryTime)
+		b, err := val.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		w.bytes(b)
+	case []string:
+		w.WriteByte(binaryStrings)
+		w.uvarint(uint64(len(val)))
+		for _, s := range val {
+			w.string(s)
+		}
+	case []interface{}:
+		w.WriteByte(binaryList)
+		w.uvarint(uint64(len(val)))
+		for _, v := range val {
+			if err := w.value(v); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		w.WriteByte(binaryMap)
+		w.uvarint(uint64(len(val)))
+		for k, v := range val {
+			w.string(k)
+			if err := w.value(v); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("binary session codec cannot encode values of type %T", val)
+	}
+	return nil
+}
+
+// binaryReader reads data written by binaryWriter.  It panics with an error if the data is bad
+type binaryReader struct {
+	*bytes.Reader
+}
+
+// recover turns a panic from the reader into an error.  Call it deferred
+func (r binaryReader) recover(err *error) {
+	if p := recover(); p != nil {
+		if e, ok := p.(error); ok {
+			if _, ok := p.(runtime.Error); !ok {
+				*err = e
+				return
+			}
+		}
+		panic(p)
+	}
+}
+
+func (r binaryReader) check(err error) {
+	if err == io.EOF {
+		err = ErrorCorruptData
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (r binaryReader) uvarint() uint64 {
+	v, err := binary.ReadUvarint(r)
+	r.check(err)
+	return v
+}
+
+func (r binaryReader) varint() int64 {
+	v, err := binary.ReadVarint(r)
+	r.check(err)
+	return v
+}
+
+// length reads a length, checking there could be that many items left in the data
+func (r binaryReader) length() int {
+	l := r.uvarint()
+	if l > uint64(r.Len()) {
+		panic(ErrorCorruptData)
+	}
+	return int(l)
+}
+
+func (r binaryReader) bytes() []byte {
+	b := make([]byte, r.length())
+	_, err := io.ReadFull(r, b)
+	r.check(err)
+	return b
+}
+
+func (r binaryReader) string() string {
+	return string(r.bytes())
+}
+
+func (r binaryReader) value() interface{} {
+	tag, err := r.ReadByte()
+	r.check(err)
+	switch tag {
+	case binaryNil:
+		return nil
+	case binaryFalse:
+		return false
+	case binaryTrue:
+		return true
+	case binaryInt:
+		return int(r.varint())
+	case binaryInt64:
+		return r.varint()
+	case binaryFloat64:
+		var b [8]byte
+		_, err := io.ReadFull(r, b[:])
+		r.check(err)
+		return math.Float64frombits(binary.LittleEndian.Uint64(b[:]))
+	case binaryString:
+		return r.string()
+	case binaryBytes:
+		return r.bytes()
+	case binaryTime:
+		var t time.Time
+		r.check(t.UnmarshalBinary(r.bytes()))
+		return t
+	case binaryStrings:
+		val := make([]string, r.length())
+		for i := range val {
+			val[i] = r.string()
+		}
+		return val
+	case binaryList:
+		val := make([]interface{}, r.length())
+		for i := range val {
+			val[i] = r.value()
+		}
+		return val
+	case binaryMap:
+		n := r.length()
+		val := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			k := r.string()
+			val[k] = r.value()
+		}
+		return val
+	}
+	panic(ErrorCorruptData)
+}
@@ -0,0 +1,108 @@
+package base
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	created := time.Date(2015, 3, 14, 9, 26, 53, 0, time.UTC)
+	for _, codec := range []Codec{GobCodec, JSONCodec, BinaryCodec} {
+		s := &Session{
+			Values:    map[string]interface{}{"cheese": "stilton"},
+			Created:   created,
+			UserId:    "wallace",
+			UserAgent: "cheese-browser/1.0",
+			Version:   300,
+		}
+		s.AddFlash(FlashInfo, "welcome back")
+
+		data, err := EncodeSession(codec, s)
+		if err != nil {
+			t.Fatalf("codec %d failed to encode - %v", codec.Id(), err)
+		}
+		if data[0] != codec.Id() {
+			t.Fatalf("codec %d data has prefix %d", codec.Id(), data[0])
+		}
+
+		var s1 Session
+		if err := DecodeSession(data, &s1); err != nil {
+			t.Fatalf("codec %d failed to decode - %v", codec.Id(), err)
+		}
+		if cheese, _ := s1.Get("cheese"); cheese != "stilton" {
+			t.Fatalf("codec %d: cheese is %v", codec.Id(), cheese)
+		}
+		if !s1.Created.Equal(created) || s1.UserId != "wallace" || s1.UserAgent != "cheese-browser/1.0" || s1.Version != 300 {
+			t.Fatalf("codec %d: session metadata not the cheese we were hoping for, %v", codec.Id(), s1)
+		}
+		flashes := s1.Flashes()
+		if !reflect.DeepEqual(flashes, []Flash{{Category: FlashInfo, Message: "welcome back"}}) {
+			t.Fatalf("codec %d: flashes are %v", codec.Id(), flashes)
+		}
+	}
+}
+
+func TestBinaryCodecTypes(t *testing.T) {
+	values := map[string]interface{}{
+		"nil":     nil,
+		"bool":    true,
+		"int":     -42,
+		"int64":   int64(1) << 40,
+		"float64": 3.25,
+		"bytes":   []byte{1, 2, 3},
+		"time":    time.Date(2015, 3, 14, 9, 26, 53, 0, time.UTC),
+		"strings": []string{"brie", "edam"},
+		"list":    []interface{}{"gouda", 7},
+		"map":     map[string]interface{}{"hat": "bowler"},
+	}
+
+	data, err := EncodeSession(BinaryCodec, &Session{Values: values})
+	if err != nil {
+		t.Fatalf("failed to encode - %v", err)
+	}
+	var s Session
+	if err := DecodeSession(data, &s); err != nil {
+		t.Fatalf("failed to decode - %v", err)
+	}
+	if !reflect.DeepEqual(s.Values, values) {
+		t.Fatalf("values are %#v", s.Values)
+	}
+
+	// Truncated data is reported, not a panic
+	for i := 1; i < len(data); i++ {
+		if err := DecodeSession(data[:i], &Session{}); err == nil {
+			t.Fatalf("expected error decoding %d bytes", i)
+		}
+	}
+
+	if _, err := EncodeSession(BinaryCodec, &Session{Values: map[string]interface{}{"c": struct{}{}}}); err == nil {
+		t.Fatalf("expected error encoding unsupported type")
+	}
+}
+
+func TestDecodeSessionUnknownCodec(t *testing.T) {
+	if err := DecodeSession([]byte{0xfe, 1, 2}, &Session{}); err != ErrorUnknownCodec {
+		t.Fatalf("expected ErrorUnknownCodec, have %v", err)
+	}
+}
+
+func TestValueCodecs(t *testing.T) {
+	for _, codec := range []Codec{GobCodec, JSONCodec, BinaryCodec} {
+		data, err := EncodeValue(codec, []interface{}{"gouda", "edam"})
+		if err != nil {
+			t.Fatalf("codec %d failed to encode - %v", codec.Id(), err)
+		}
+		val, err := DecodeValue(data)
+		if err != nil {
+			t.Fatalf("codec %d failed to decode - %v", codec.Id(), err)
+		}
+		if !reflect.DeepEqual(val, []interface{}{"gouda", "edam"}) {
+			t.Fatalf("codec %d: value is %#v", codec.Id(), val)
+		}
+	}
+
+	if _, err := DecodeValue([]byte{CODEC_BINARY, 200}); err == nil {
+		t.Fatalf("expected error decoding bad data")
+	}
+}
@@ -0,0 +1,100 @@
+package base
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	// How many times the session middleware tries to save a session that conflicts with another request
+	MAX_CONFLICT_RETRIES = 3
+)
+
+/*
+ConflictHandler is called by the session middleware when session can't be saved because another
+request has saved it since it was loaded.  current is the session as it is now stored.
+
+To retry, update session, for example by merging in the changes from current, set
+session.Version to current.Version and return true.  The session middleware then tries to save it
+again.  Return false to give up, losing the changes made by this request.  Either way the handler
+might log the conflict or record it for reporting.
+*/
+type ConflictHandler func(c *web.C, session, current *Session) bool
+
+/*
+MergeChanges is a ConflictHandler that merges the values Put and Del'd in this request into the
+current session.  If the changes aren't known, for example because the session was marked dirty
+with SetDirty, the whole session overwrites the current one.
+*/
+func MergeChanges(c *web.C, session, current *Session) bool {
+	if changes, partial := session.Changes(); partial {
+		values := make(map[string]interface{}, len(current.Values))
+		for key, value := range current.Values {
+			values[key] = value
+		}
+		for key, put := range changes {
+			if put {
+				values[key] = session.Values[key]
+			} else {
+				delete(values, key)
+			}
+		}
+		session.Values = values
+	}
+	session.Version = current.Version
+	return true
+}
+
+/*
+KeepStored is a ConflictHandler that drops this request's changes, keeping the session saved by
+the other request
+*/
+func KeepStored(c *web.C, session, current *Session) bool {
+	log.Printf("Session %s changed by another request. Changes from this request not saved", session.Id())
+	return false
+}
+
+// cookieNamer is implemented by SessionHolders built on BaseSessionHolder
+type cookieNamer interface {
+	cookieName() string
+}
+
+// save saves the session, calling the ConflictHandler if it conflicts with another request
+func (w *sessionResponseWriter) save(session *Session) error {
+	onConflict := w.onConflict
+	if onConflict == nil {
+		onConflict = MergeChanges
+	}
+
+	for i := 0; ; i++ {
+		err := w.sh.Save(*w.c, session)
+		if err != ErrorSessionConflict || i == MAX_CONFLICT_RETRIES {
+			return err
+		}
+		current, err := w.load(session.Id())
+		if err != nil {
+			return err
+		}
+		if !onConflict(w.c, session, current) {
+			return nil
+		}
+	}
+}
+
+// load gets the stored session with the given Id
+func (w *sessionResponseWriter) load(sessionId string) (*Session, error) {
+	cn, ok := w.sh.(cookieNamer)
+	if !ok {
+		return nil, ErrorSessionConflict
+	}
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: cn.cookieName(), Value: sessionId})
+
+	current, err := w.sh.Get(*w.c, r)
+	if err == ErrorSessionExpired && current != nil {
+		err = nil
+	}
+	return current, err
+}
@@ -0,0 +1,162 @@
+package base
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+)
+
+func TestMemorySessionConflict(t *testing.T) {
+	c := makeEnv()
+	sh := NewLimitedMemorySessionHolder(30, 0)
+	defer sh.Close()
+
+	s := sh.Create(c)
+	s.Put("cheese", "cheddar")
+	if err := sh.Save(c, s); err != nil {
+		t.Fatalf("failed to save session - %v", err)
+	}
+
+	s1, _ := sh.Get(c, requestForSession(s))
+	s2, _ := sh.Get(c, requestForSession(s))
+	s1.Put("cheese", "brie")
+	if err := sh.Save(c, s1); err != nil {
+		t.Fatalf("failed to save session - %v", err)
+	}
+	s2.Put("cheese", "edam")
+	if err := sh.Save(c, s2); err != ErrorSessionConflict {
+		t.Fatalf("expected ErrorSessionConflict, have %v", err)
+	}
+	if err := sh.Save(c, s1); err != nil {
+		t.Fatalf("saving again should not conflict - %v", err)
+	}
+}
+
+func TestMemorySessionRevoked(t *testing.T) {
+	c := makeEnv()
+	sh := NewLimitedMemorySessionHolder(30, 0)
+	defer sh.Close()
+
+	s := sh.Create(c)
+	s.Put("cheese", "cheddar")
+	if err := sh.Save(c, s); err != nil {
+		t.Fatalf("failed to save session - %v", err)
+	}
+
+	// A request loads the session, then the session is revoked before the request saves it
+	loaded, _ := sh.Get(c, requestForSession(s))
+	if err := sh.Destroy(makeEnv(), s); err != nil {
+		t.Fatalf("failed to destroy session - %v", err)
+	}
+	loaded.Put("cheese", "brie")
+	if err := sh.Save(c, loaded); err != ErrorSessionNotFound {
+		t.Fatalf("expected ErrorSessionNotFound, have %v", err)
+	}
+	if _, err := sh.RegenerateId(c, loaded); err != ErrorSessionNotFound {
+		t.Fatalf("expected ErrorSessionNotFound regenerating the Id, have %v", err)
+	}
+	if sh.Len() != 0 {
+		t.Fatalf("destroyed session was saved, have %d sessions", sh.Len())
+	}
+}
+
+func TestMemorySessionRegenerateId(t *testing.T) {
+	c := makeEnv()
+	sh := NewLimitedMemorySessionHolder(30, 0)
+	defer sh.Close()
+
+	s := sh.Create(c)
+	s.Put("cheese", "cheddar")
+	if err := sh.Save(c, s); err != nil {
+		t.Fatalf("failed to save session - %v", err)
+	}
+
+	// Changes not yet saved aren't stored under the new Id until the session is saved
+	loaded, _ := sh.Get(c, requestForSession(s))
+	loaded.Put("cheese", "brie")
+	if _, err := sh.RegenerateId(c, loaded); err != nil {
+		t.Fatalf("failed to regenerate Id - %v", err)
+	}
+	if _, err := sh.Get(c, requestForSession(s)); err != ErrorSessionNotFound {
+		t.Fatalf("session still found under its old Id, %v", err)
+	}
+	stored, err := sh.Get(c, requestForSession(loaded))
+	if err != nil {
+		t.Fatalf("session not found under its new Id - %v", err)
+	}
+	if cheese, _ := stored.Get("cheese"); cheese != "cheddar" || stored.Version != loaded.Version {
+		t.Fatalf("expected the stored session, have %v version %d", cheese, stored.Version)
+	}
+	if err := sh.Save(c, loaded); err != nil {
+		t.Fatalf("failed to save session - %v", err)
+	}
+	stored, _ = sh.Get(c, requestForSession(loaded))
+	if cheese, _ := stored.Get("cheese"); cheese != "brie" || sh.Len() != 1 {
+		t.Fatalf("expected saved changes, have %v with %d sessions", cheese, sh.Len())
+	}
+}
+
+func TestSessionMiddlewareConflict(t *testing.T) {
+	sh := NewLimitedMemorySessionHolder(30, 0)
+	defer sh.Close()
+
+	c := makeEnv()
+	s := sh.Create(c)
+	s.Put("cheese", "cheddar")
+	s.Put("hat", "bowler")
+	if err := sh.Save(c, s); err != nil {
+		t.Fatalf("failed to save session - %v", err)
+	}
+
+	// While the handler runs another request changes the session
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		other, _ := sh.Get(makeEnv(), requestForSession(s))
+		other.Put("cheese", "brie")
+		if err := sh.Save(makeEnv(), other); err != nil {
+			t.Fatalf("failed to save session - %v", err)
+		}
+
+		session, _ := SessionFromEnv(&c)
+		session.Put("coat", "mac")
+		session.Del("hat")
+	})
+
+	// By default the changes are merged
+	c = makeEnv()
+	BuildSessionMiddleware(sh)(&c, h).ServeHTTP(httptest.NewRecorder(), requestForSession(s))
+	stored, err := sh.Get(c, requestForSession(s))
+	if err != nil {
+		t.Fatalf("failed to get session - %v", err)
+	}
+	if cheese, _ := stored.Get("cheese"); cheese != "brie" {
+		t.Fatalf("cheese is %v", cheese)
+	}
+	if coat, _ := stored.Get("coat"); coat != "mac" {
+		t.Fatalf("coat is %v", coat)
+	}
+	if _, ok := stored.Get("hat"); ok {
+		t.Fatalf("hat should be deleted")
+	}
+
+	// KeepStored drops them
+	var conflicts int
+	m := BuildSessionMiddlewareWithOptions(sh, SessionOptions{
+		OnConflict: func(c *web.C, session, current *Session) bool {
+			conflicts++
+			return KeepStored(c, session, current)
+		},
+	})
+	stored.Put("hat", "trilby")
+	sh.Save(c, stored)
+	c = makeEnv()
+	m(&c, h).ServeHTTP(httptest.NewRecorder(), requestForSession(s))
+	stored, _ = sh.Get(c, requestForSession(s))
+	if conflicts != 1 {
+		t.Fatalf("expected 1 conflict, have %d", conflicts)
+	}
+	if hat, _ := stored.Get("hat"); hat != "trilby" {
+		t.Fatalf("hat is %v", hat)
+	}
+}
@@ -0,0 +1,318 @@
+package base
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	// Browsers need only store cookies up to 4096 bytes, including the name and attributes
+	MAX_COOKIE_SIZE = 4096
+
+	// Minimum length of the key used to sign session cookies
+	MIN_COOKIE_KEY_SIZE = 32
+)
+
+var (
+	ErrorCookieTooLarge error = errors.New("Session is too large to store in a cookie")
+	ErrorKeyTooShort    error = errors.New("Cookie session key is too short")
+	ErrorNoCookieKeys   error = errors.New("At least one cookie session key is needed")
+)
+
+// cookieSession is what we encode into the cookie
+type cookieSession struct {
+	Id      string
+	Created int64
+	// Zero if the session never expires
+	Expires   int64
+	Values    map[string]interface{}
+	UserId    string
+	UserAgent string
+}
+
+/*
+CookieSessionHolder is a SessionHolder that keeps the session values in the session cookie
+itself.  Depending on how it is created the cookie is either signed with HMAC-SHA256, so that
+the values can't be altered by the client, or encrypted with AES-GCM, so that they can't be read
+either.  No server-side store is needed, but note
+
+  - with a signed cookie the client can read the values, they are only protected against tampering
+  - the encoded session, plus the cookie attributes, must fit in MAX_COOKIE_SIZE bytes
+  - values are gob-encoded, so any types other than the basic ones must be gob.Register()ed
+  - Destroy can't revoke a cookie the client has kept a copy of. It remains valid until it expires
+
+The expiry time is protected along with the values.  It is refreshed when the session is saved,
+and sessions that are more than half way to expiry are saved on the next request.
+
+Several keys may be configured.  The first is used to protect new cookies and all are accepted, so
+keys can be rotated without logging everyone out.  A session read using an old key is marked dirty
+so that it is sent back protected by the current key.
+*/
+type CookieSessionHolder struct {
+	BaseSessionHolder
+	sealer cookieSealer
+}
+
+/*
+NewCookieSessionHolder creates a SessionHolder that stores sessions in cookies signed with key.
+key should be at least MIN_COOKIE_KEY_SIZE random bytes, and must be the same for all instances
+of a service.  Cookies signed with any of oldKeys are also accepted.
+*/
+func NewCookieSessionHolder(timeout int, key []byte, oldKeys ...[]byte) (SessionHolder, error) {
+	keys := append([][]byte{key}, oldKeys...)
+	for _, k := range keys {
+		if len(k) < MIN_COOKIE_KEY_SIZE {
+			return nil, ErrorKeyTooShort
+		}
+	}
+
+	return &CookieSessionHolder{
+		BaseSessionHolder: NewBaseSessionHolder(timeout),
+		sealer:            &hmacSealer{keys: keys},
+	}, nil
+}
+
+/*
+NewEncryptedCookieSessionHolder creates a SessionHolder that stores sessions in cookies encrypted
+with AES-GCM.  Each key must be 16, 24 or 32 random bytes, selecting AES-128, AES-192 or AES-256.
+The first key encrypts, and all the keys are tried when decrypting.
+*/
+func NewEncryptedCookieSessionHolder(timeout int, keys ...[]byte) (SessionHolder, error) {
+	if len(keys) == 0 {
+		return nil, ErrorNoCookieKeys
+	}
+	aeads := make([]cipher.AEAD, len(keys))
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aeads[i], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &CookieSessionHolder{
+		BaseSessionHolder: NewBaseSessionHolder(timeout),
+		sealer:            &aeadSealer{aeads: aeads},
+	}, nil
+}
+
+/*
+Get the session from the cookie in the request.
+
+Returns ErrorSessionNotFound if there is no cookie, or the cookie has been tampered with, and
+ErrorSessionExpired if it has expired
+*/
+func (sh *CookieSessionHolder) Get(c web.C, r *http.Request) (*Session, error) {
+	value := sh.getCookieValue(r)
+	if value == "" {
+		return nil, ErrorSessionNotFound
+	}
+
+	data, stale, ok := sh.sealer.open(value)
+	if !ok {
+		return nil, ErrorSessionNotFound
+	}
+
+	var cs cookieSession
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cs); err != nil {
+		// The cookie is genuine, so this is something like a value type that's no longer registered
+		log.Printf("could not decode session cookie. %v", err)
+		return nil, ErrorSessionNotFound
+	}
+
+	session := &Session{
+		id:        cs.Id,
+		Values:    cs.Values,
+		Created:   time.Unix(cs.Created, 0),
+		UserId:    cs.UserId,
+		UserAgent: cs.UserAgent,
+	}
+	if session.Values == nil {
+		session.Values = make(map[string]interface{})
+	}
+
+	remaining := cs.Expires - time.Now().Unix()
+	if cs.Expires != 0 && remaining <= 0 {
+		return session, ErrorSessionExpired
+	}
+
+	// Sliding expiry - refresh the cookie once we're half way to expiring.  Also refresh if an old key
+	// was used, to move the client to the current key
+	session.SetDirty(stale || (cs.Expires != 0 && remaining < int64(sh.Timeout/2)))
+	return session, nil
+}
+
+/*
+Destroy the session.
+
+This just removes the session from c.Env.  BuildSessionMiddleware will tell the client to discard
+the cookie
+*/
+func (sh *CookieSessionHolder) Destroy(c web.C, session *Session) error {
+	delete(c.Env, "session")
+	return nil
+}
+
+/*
+Save checks the session can be encoded into a cookie.
+
+The cookie itself is written by AddToResponse.  Returns ErrorCookieTooLarge if the session won't fit
+*/
+func (sh *CookieSessionHolder) Save(c web.C, session *Session) error {
+	_, err := sh.encode(session)
+	return err
+}
+
+/*
+RegenerateId gives the session a new Id.  The session is marked dirty so that a new cookie is sent
+*/
+func (sh *CookieSessionHolder) RegenerateId(c web.C, session *Session) (string, error) {
+	session.SetId(sh.GenerateSessionId())
+	session.SetDirty(true)
+	return session.Id(), nil
+}
+
+/*
+ResetTTL does nothing. The expiry time is held in the cookie, so is only updated when the
+session is saved
+*/
+func (sh *CookieSessionHolder) ResetTTL(c web.C, session *Session) error {
+	return nil
+}
+
+/*
+AddToResponse writes the session into the session cookie, protected by the current key
+*/
+func (sh *CookieSessionHolder) AddToResponse(c web.C, session *Session, w http.ResponseWriter) {
+	cookie, err := sh.encode(session)
+	if err != nil {
+		log.Printf("could not add session cookie to response. %v", err)
+		return
+	}
+	http.SetCookie(w, cookie)
+}
+
+// encode builds the session cookie for session
+func (sh *CookieSessionHolder) encode(session *Session) (*http.Cookie, error) {
+	now := time.Now()
+	cs := cookieSession{
+		Id:        session.Id(),
+		Created:   session.Created.Unix(),
+		Values:    session.Values,
+		UserId:    session.UserId,
+		UserAgent: session.UserAgent,
+	}
+	if expires := sh.ExpiresAt(session, now); !expires.IsZero() {
+		cs.Expires = expires.Unix()
+	}
+
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(&cs); err != nil {
+		return nil, err
+	}
+
+	value, err := sh.sealer.seal(b.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	cookie := sh.sessionCookie(value, sh.StoreTTL(session, now))
+	if len(cookie.String()) > MAX_COOKIE_SIZE {
+		return nil, ErrorCookieTooLarge
+	}
+	return cookie, nil
+}
+
+// cookieSealer protects the encoded session in the cookie
+type cookieSealer interface {
+	// seal protects data with the current key, and encodes it so it is safe to put in a cookie
+	seal(data []byte) (string, error)
+	// open returns the data in a value built by seal if it is genuine.  stale is true if the
+	// data was protected with an old key
+	open(value string) (data []byte, stale bool, ok bool)
+}
+
+// hmacSealer signs data with HMAC-SHA256
+type hmacSealer struct {
+	keys [][]byte
+}
+
+func (s *hmacSealer) seal(data []byte) (string, error) {
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sign(s.keys[0], payload)), nil
+}
+
+func (s *hmacSealer) open(value string) ([]byte, bool, bool) {
+	dot := strings.LastIndexByte(value, '.')
+	if dot < 0 {
+		return nil, false, false
+	}
+	payload := value[:dot]
+	sig, err := base64.RawURLEncoding.DecodeString(value[dot+1:])
+	if err != nil {
+		return nil, false, false
+	}
+	for i, key := range s.keys {
+		if hmac.Equal(sig, sign(key, payload)) {
+			data, err := base64.RawURLEncoding.DecodeString(payload)
+			if err != nil {
+				return nil, false, false
+			}
+			return data, i > 0, true
+		}
+	}
+	return nil, false, false
+}
+
+func sign(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// aeadSealer encrypts data with an AEAD cipher such as AES-GCM
+type aeadSealer struct {
+	aeads []cipher.AEAD
+}
+
+func (s *aeadSealer) seal(data []byte) (string, error) {
+	aead := s.aeads[0]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := crand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, data, nil)), nil
+}
+
+func (s *aeadSealer) open(value string) ([]byte, bool, bool) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, false, false
+	}
+	for i, aead := range s.aeads {
+		if len(sealed) < aead.NonceSize() {
+			continue
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		if data, err := aead.Open(nil, nonce, ciphertext, nil); err == nil {
+			return data, i > 0, true
+		}
+	}
+	return nil, false, false
+}
@@ -0,0 +1,255 @@
+package base
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testCookieKey = []byte("0123456789abcdef0123456789abcdef")
+
+// requestWithCookies builds a request carrying the cookies set on a response
+func requestWithCookies(w *httptest.ResponseRecorder) *http.Request {
+	r, _ := http.NewRequest("GET", "/", nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+func TestCookieSessionKeyTooShort(t *testing.T) {
+	_, err := NewCookieSessionHolder(30, []byte("short"))
+	if err != ErrorKeyTooShort {
+		t.Fatalf("expected ErrorKeyTooShort, got %v", err)
+	}
+}
+
+func TestCookieSession(t *testing.T) {
+	c := makeEnv()
+	sh, err := NewCookieSessionHolder(30, testCookieKey)
+	if err != nil {
+		t.Fatalf("failed to create session holder - %v", err)
+	}
+
+	s := sh.Create(c)
+	s.Put("cheese", "cheddar")
+	if err := sh.Save(c, s); err != nil {
+		t.Fatalf("failed to save session - %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	sh.AddToResponse(c, s, w)
+
+	s1, err := sh.Get(c, requestWithCookies(w))
+	if err != nil {
+		t.Fatalf("failed to get session from cookie - %v", err)
+	}
+	if s1.Id() != s.Id() {
+		t.Fatalf("session ID not preserved. %s != %s", s1.Id(), s.Id())
+	}
+	if s1.IsDirty() {
+		t.Fatalf("fresh session should not be dirty")
+	}
+	cheese, ok := s1.Get("cheese")
+	if !ok || cheese.(string) != "cheddar" {
+		t.Fatalf("not the cheese we were hoping for. %v %v", ok, cheese)
+	}
+}
+
+func TestCookieSessionTampered(t *testing.T) {
+	c := makeEnv()
+	sh, _ := NewCookieSessionHolder(30, testCookieKey)
+
+	s := sh.Create(c)
+	s.Put("admin", false)
+	w := httptest.NewRecorder()
+	sh.AddToResponse(c, s, w)
+	cookie := w.Result().Cookies()[0]
+
+	tests := []string{
+		"",
+		"nodot",
+		"x" + cookie.Value,
+		cookie.Value[:len(cookie.Value)-2],
+		strings.Replace(cookie.Value, ".", ".x", 1),
+	}
+
+	for _, value := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "sessionid", Value: value})
+		if _, err := sh.Get(c, r); err != ErrorSessionNotFound {
+			t.Errorf("expected session not found for %q, got %v", value, err)
+		}
+	}
+
+	// A cookie signed with a different key is rejected
+	other, _ := NewCookieSessionHolder(30, []byte("fedcba9876543210fedcba9876543210"))
+	if _, err := other.Get(c, requestWithCookies(w)); err != ErrorSessionNotFound {
+		t.Errorf("expected session not found for cookie with other key, got %v", err)
+	}
+}
+
+func TestCookieSessionExpired(t *testing.T) {
+	c := makeEnv()
+	sh, _ := NewCookieSessionHolder(30, testCookieKey)
+	sh.(MaxLifetimeSetter).SetMaxLifetime(60)
+
+	// A session created long ago has passed its maximum lifetime
+	s := sh.Create(c)
+	s.Created = s.Created.Add(-time.Hour)
+	w := httptest.NewRecorder()
+	sh.AddToResponse(c, s, w)
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sessionid", Value: w.Result().Cookies()[0].Value})
+	s1, err := sh.Get(c, r)
+	if err != ErrorSessionExpired {
+		t.Fatalf("expected session to have expired, got %v", err)
+	}
+	if s1 == nil || s1.Id() != s.Id() {
+		t.Fatalf("expected expired session to be returned")
+	}
+}
+
+func TestCookieSessionTooLarge(t *testing.T) {
+	c := makeEnv()
+	sh, _ := NewCookieSessionHolder(30, testCookieKey)
+
+	s := sh.Create(c)
+	s.Put("big", strings.Repeat("x", MAX_COOKIE_SIZE))
+	if err := sh.Save(c, s); err != ErrorCookieTooLarge {
+		t.Fatalf("expected ErrorCookieTooLarge, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	sh.AddToResponse(c, s, w)
+	if cookie := w.HeaderMap.Get("Set-Cookie"); cookie != "" {
+		t.Fatalf("expected no cookie, have %s", cookie)
+	}
+}
+
+func TestCookieSessionMiddleware(t *testing.T) {
+	sh, _ := NewCookieSessionHolder(30, testCookieKey)
+	m := BuildSessionMiddleware(sh)
+
+	// The first request creates a session and writes to it
+	c := makeEnv()
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, _ := SessionFromEnv(&c)
+		s.Put("cheese", "stilton")
+		w.Write([]byte("hello"))
+	})
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	m(&c, h).ServeHTTP(w, r)
+
+	// The second request sees the value and logs out
+	c = makeEnv()
+	var cheese interface{}
+	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, _ := SessionFromEnv(&c)
+		cheese, _ = s.Get("cheese")
+		Logout(&c)
+	})
+	w1 := httptest.NewRecorder()
+	m(&c, h).ServeHTTP(w1, requestWithCookies(w))
+
+	if cheese != "stilton" {
+		t.Fatalf("session value not carried in cookie. Have %v", cheese)
+	}
+
+	cookies := w1.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Fatalf("expected cookie to be removed, have %v", cookies)
+	}
+}
+
+func TestEncryptedCookieSession(t *testing.T) {
+	c := makeEnv()
+	if _, err := NewEncryptedCookieSessionHolder(30); err != ErrorNoCookieKeys {
+		t.Fatalf("expected ErrorNoCookieKeys, got %v", err)
+	}
+	if _, err := NewEncryptedCookieSessionHolder(30, []byte("not an AES key")); err == nil {
+		t.Fatalf("expected error for bad key size")
+	}
+
+	sh, err := NewEncryptedCookieSessionHolder(30, testCookieKey)
+	if err != nil {
+		t.Fatalf("failed to create session holder - %v", err)
+	}
+
+	s := sh.Create(c)
+	s.Put("secret", "the cheese is a lie")
+	w := httptest.NewRecorder()
+	sh.AddToResponse(c, s, w)
+
+	if strings.Contains(w.HeaderMap.Get("Set-Cookie"), s.Id()) {
+		t.Fatalf("session ID visible in encrypted cookie")
+	}
+
+	s1, err := sh.Get(c, requestWithCookies(w))
+	if err != nil {
+		t.Fatalf("failed to get session from cookie - %v", err)
+	}
+	if s1.IsDirty() {
+		t.Fatalf("session read with current key should not be dirty")
+	}
+	secret, _ := s1.Get("secret")
+	if s1.Id() != s.Id() || secret != "the cheese is a lie" {
+		t.Fatalf("session not decrypted correctly. %s %v", s1.Id(), secret)
+	}
+
+	// Tampering is detected
+	r, _ := http.NewRequest("GET", "/", nil)
+	sealed, err := base64.RawURLEncoding.DecodeString(w.Result().Cookies()[0].Value)
+	if err != nil {
+		t.Fatalf("cookie is not base64. %v", err)
+	}
+	sealed[len(sealed)/2] ^= 1
+	r.AddCookie(&http.Cookie{Name: "sessionid", Value: base64.RawURLEncoding.EncodeToString(sealed)})
+	if _, err := sh.Get(c, r); err != ErrorSessionNotFound {
+		t.Fatalf("expected tampered cookie to be rejected, got %v", err)
+	}
+}
+
+func TestEncryptedCookieSessionKeyRotation(t *testing.T) {
+	oldKey := []byte("0123456789abcdef")
+	newKey := []byte("fedcba9876543210")
+
+	oldSh, _ := NewEncryptedCookieSessionHolder(30, oldKey)
+	sh, _ := NewEncryptedCookieSessionHolder(30, newKey, oldKey)
+	newSh, _ := NewEncryptedCookieSessionHolder(30, newKey)
+
+	c := makeEnv()
+	s := oldSh.Create(c)
+	s.Put("cheese", "brie")
+	w := httptest.NewRecorder()
+	oldSh.AddToResponse(c, s, w)
+
+	if _, err := newSh.Get(c, requestWithCookies(w)); err != ErrorSessionNotFound {
+		t.Fatalf("expected cookie with unknown key to be rejected, got %v", err)
+	}
+
+	// A request through the middleware with both keys moves the cookie to the new key
+	c = makeEnv()
+	m := BuildSessionMiddleware(sh)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, ok := SessionFromEnv(&c)
+		if !ok || !s.IsDirty() {
+			t.Errorf("expected session read with old key to be dirty")
+		}
+	})
+	w1 := httptest.NewRecorder()
+	m(&c, h).ServeHTTP(w1, requestWithCookies(w))
+
+	s1, err := newSh.Get(c, requestWithCookies(w1))
+	if err != nil {
+		t.Fatalf("session not re-encrypted with new key - %v", err)
+	}
+	if cheese, _ := s1.Get("cheese"); s1.Id() != s.Id() || cheese != "brie" {
+		t.Fatalf("session not preserved over key rotation. %s %v", s1.Id(), cheese)
+	}
+}
@@ -0,0 +1,169 @@
+package base
+
+import (
+	crand "crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	// Session key for the CSRF secret
+	CSRF_SECRET_KEY = "_csrf"
+	// Session key for the Id of the session the CSRF secret was issued to
+	CSRF_SESSION_ID_KEY = "_csrfsid"
+	// Form field checked for the CSRF token
+	CSRF_FIELD = "csrf_token"
+	// Header checked for the CSRF token
+	CSRF_HEADER = "X-CSRF-Token"
+
+	csrfSecretBytes = 32
+)
+
+/*
+BuildCSRFMiddleware builds middleware that protects against cross-site request forgery.  It must be
+used after the session middleware, and works with any SessionHolder.
+
+The middleware
+
+  - keeps a random secret in the session
+  - puts a token derived from the secret in c.Env["csrftoken"], for including in forms as a hidden
+    CSRF_FIELD field, or for scripts to send in the CSRF_HEADER header
+  - puts a func() string that returns a token in c.Env["csrftokenfunc"]
+  - checks the token on all requests except GET, HEAD, OPTIONS and TRACE, returning 403 Forbidden if
+    it is missing or wrong
+
+Sessions that the session middleware creates lazily (see SessionOptions.LazyCreate) are only given
+a secret when a token is asked for, so they stay unsaved unless a form is rendered.  For those
+c.Env["csrftoken"] is not set, so get tokens from c.Env["csrftokenfunc"] or CSRFTokenFromEnv().
+
+The token is masked with a fresh random pad on every request, so it is different each time it is
+rendered, which defeats compression attacks such as BREACH.  The secret is rotated whenever the
+session Id changes, for example after RegenerateId when a user logs in.  Use CSRFTokenFromEnv()
+to get a valid token after RegenerateId.
+
+exempt, if not nil, is called for requests that would be checked.  Return true to skip the check,
+for example for webhooks that are authenticated in some other way.
+*/
+func BuildCSRFMiddleware(exempt func(c *web.C, r *http.Request) bool) func(c *web.C, h http.Handler) http.Handler {
+	return func(c *web.C, h http.Handler) http.Handler {
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			session, ok := SessionFromEnv(c)
+			if !ok {
+				log.Printf("CSRF middleware requires a session")
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			secret := existingCSRFSecret(session)
+			if secret == nil && !(session.lazy && !session.IsDirty()) {
+				secret = csrfSecret(session)
+			}
+			if secret != nil {
+				c.Env["csrftoken"] = maskCSRFSecret(secret)
+			}
+			c.Env["csrftokenfunc"] = func() string {
+				return CSRFTokenFromEnv(c)
+			}
+
+			if !isSafeMethod(r.Method) && (exempt == nil || !exempt(c, r)) {
+				token := r.Header.Get(CSRF_HEADER)
+				if token == "" {
+					token = r.PostFormValue(CSRF_FIELD)
+				}
+				// Without a secret no token was ever issued, so none can be valid
+				if secret == nil || !validCSRFToken(token, secret) {
+					http.Error(w, "CSRF token missing or invalid", http.StatusForbidden)
+					return
+				}
+			}
+
+			h.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(handler)
+	}
+}
+
+/*
+CSRFTokenFromEnv returns a CSRF token for the current session, creating the session's secret if it
+doesn't have one.  If the session Id has changed since the CSRF middleware ran, the secret is
+rotated.  c.Env["csrftoken"] is updated
+*/
+func CSRFTokenFromEnv(c *web.C) string {
+	session, ok := SessionFromEnv(c)
+	if !ok {
+		return ""
+	}
+	token, ok := c.Env["csrftoken"].(string)
+	if id, _ := session.Get(CSRF_SESSION_ID_KEY); !ok || id != session.Id() {
+		token = maskCSRFSecret(csrfSecret(session))
+		c.Env["csrftoken"] = token
+	}
+	return token
+}
+
+// existingCSRFSecret returns the CSRF secret for the session, or nil if it doesn't have one
+func existingCSRFSecret(session *Session) []byte {
+	if id, _ := session.Get(CSRF_SESSION_ID_KEY); id == session.Id() {
+		encoded, _ := session.Get(CSRF_SECRET_KEY)
+		if s, ok := encoded.(string); ok {
+			secret, err := base64.RawURLEncoding.DecodeString(s)
+			if err == nil && len(secret) == csrfSecretBytes {
+				return secret
+			}
+		}
+	}
+	return nil
+}
+
+// csrfSecret returns the CSRF secret for the session, creating one if necessary
+func csrfSecret(session *Session) []byte {
+	if secret := existingCSRFSecret(session); secret != nil {
+		return secret
+	}
+
+	// No secret, or the secret was issued to the session under a different Id
+	secret := make([]byte, csrfSecretBytes)
+	if _, err := crand.Read(secret); err != nil {
+		log.Panicf("Could not get random bytes for CSRF secret, %v", err)
+	}
+	session.Put(CSRF_SECRET_KEY, base64.RawURLEncoding.EncodeToString(secret))
+	session.Put(CSRF_SESSION_ID_KEY, session.Id())
+	return secret
+}
+
+// maskCSRFSecret builds a token from the secret.  The token is a random pad followed by the secret XOR the pad
+func maskCSRFSecret(secret []byte) string {
+	token := make([]byte, 2*len(secret))
+	pad := token[:len(secret)]
+	if _, err := crand.Read(pad); err != nil {
+		log.Panicf("Could not get random bytes for CSRF token, %v", err)
+	}
+	for i, b := range secret {
+		token[len(secret)+i] = b ^ pad[i]
+	}
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+func validCSRFToken(token string, secret []byte) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) != 2*len(secret) {
+		return false
+	}
+	unmasked := make([]byte, len(secret))
+	for i := range unmasked {
+		unmasked[i] = raw[i] ^ raw[len(secret)+i]
+	}
+	return subtle.ConstantTimeCompare(unmasked, secret) == 1
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package base
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+)
+
+func TestCSRF(t *testing.T) {
+	sh := NewMemorySessionHolder(30)
+	sm := BuildSessionMiddleware(sh)
+	cm := BuildCSRFMiddleware(func(c *web.C, r *http.Request) bool {
+		return r.URL.Path == "/webhook"
+	})
+
+	var token string
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		c := makeEnv()
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token = CSRFTokenFromEnv(&c)
+			w.WriteHeader(200)
+		})
+		w := httptest.NewRecorder()
+		sm(&c, cm(&c, h)).ServeHTTP(w, r)
+		return w
+	}
+
+	r, _ := http.NewRequest("GET", "/form", nil)
+	w := serve(r)
+	if w.Code != 200 || token == "" {
+		t.Fatalf("expected GET to succeed with a token, have %d %q", w.Code, token)
+	}
+	cookies := w.Result().Cookies()
+	firstToken := token
+
+	post := func(path string, header string, form string) int {
+		r, _ := http.NewRequest("POST", path, strings.NewReader(form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if header != "" {
+			r.Header.Set(CSRF_HEADER, header)
+		}
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		return serve(r).Code
+	}
+
+	tests := []struct {
+		path   string
+		header string
+		form   string
+		code   int
+	}{
+		{path: "/form", code: 403},
+		{path: "/form", header: "rubbish", code: 403},
+		{path: "/form", form: CSRF_FIELD + "=" + url.QueryEscape(firstToken[1:]), code: 403},
+		{path: "/form", header: firstToken, code: 200},
+		{path: "/form", form: CSRF_FIELD + "=" + url.QueryEscape(firstToken), code: 200},
+		{path: "/webhook", code: 200},
+	}
+	for _, test := range tests {
+		if code := post(test.path, test.header, test.form); code != test.code {
+			t.Errorf("POST %s header %q form %q: expected %d, have %d", test.path, test.header, test.form, test.code, code)
+		}
+	}
+
+	// Tokens are masked differently on each request, but all are valid
+	if token == firstToken {
+		t.Errorf("expected a different token on each request")
+	}
+	if code := post("/form", token, ""); code != 200 {
+		t.Errorf("expected second token to be valid, have %d", code)
+	}
+}
+
+func TestCSRFRotatedOnRegenerateId(t *testing.T) {
+	c := makeEnv()
+	sh := NewMemorySessionHolder(30)
+	s := sh.Create(c)
+
+	token := CSRFTokenFromEnv(&c)
+	secret := csrfSecret(s)
+	if !validCSRFToken(token, secret) {
+		t.Fatalf("token not valid for session secret")
+	}
+
+	sh.RegenerateId(c, s)
+	newToken := CSRFTokenFromEnv(&c)
+	if validCSRFToken(token, csrfSecret(s)) {
+		t.Fatalf("old token still valid after RegenerateId")
+	}
+	if !validCSRFToken(newToken, csrfSecret(s)) {
+		t.Fatalf("new token not valid after RegenerateId")
+	}
+}
+
+func TestCSRFLazySession(t *testing.T) {
+	sh := NewLimitedMemorySessionHolder(30, 0)
+	defer sh.Close()
+	sm := BuildSessionMiddlewareWithOptions(sh, SessionOptions{LazyCreate: true})
+	cm := BuildCSRFMiddleware(nil)
+
+	serve := func(r *http.Request, wantToken bool) (*httptest.ResponseRecorder, string) {
+		c := makeEnv()
+		var token string
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if wantToken {
+				token = CSRFTokenFromEnv(&c)
+			}
+			w.WriteHeader(200)
+		})
+		w := httptest.NewRecorder()
+		sm(&c, cm(&c, h)).ServeHTTP(w, r)
+		return w, token
+	}
+
+	// A page without a form doesn't create a session
+	r, _ := http.NewRequest("GET", "/health", nil)
+	w, _ := serve(r, false)
+	if w.Code != 200 || w.Header().Get("Set-Cookie") != "" || sh.Len() != 0 {
+		t.Fatalf("expected no session, have %d %q and %d sessions", w.Code, w.Header().Get("Set-Cookie"), sh.Len())
+	}
+
+	// Nor does a POST without one, which has no valid token
+	r, _ = http.NewRequest("POST", "/form", nil)
+	r.Header.Set(CSRF_HEADER, "")
+	if w, _ := serve(r, false); w.Code != 403 || sh.Len() != 0 {
+		t.Fatalf("expected POST without a session to be refused, have %d and %d sessions", w.Code, sh.Len())
+	}
+
+	// Asking for a token creates the session
+	r, _ = http.NewRequest("GET", "/form", nil)
+	w, token := serve(r, true)
+	if token == "" || w.Header().Get("Set-Cookie") == "" || sh.Len() != 1 {
+		t.Fatalf("expected a session with a token, have %q %q", token, w.Header().Get("Set-Cookie"))
+	}
+
+	r, _ = http.NewRequest("POST", "/form", nil)
+	r.Header.Set(CSRF_HEADER, token)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	if w, _ := serve(r, false); w.Code != 200 {
+		t.Fatalf("expected POST with the token to succeed, have %d", w.Code)
+	}
+}
+
+func TestCSRFTokenInEnv(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		sh := NewLimitedMemorySessionHolder(30, 0)
+		sm := BuildSessionMiddlewareWithOptions(sh, SessionOptions{LazyCreate: lazy})
+		cm := BuildCSRFMiddleware(nil)
+
+		// A template renders the token for a fresh session from c.Env
+		var token string
+		serve := func(r *http.Request) *httptest.ResponseRecorder {
+			c := makeEnv()
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if lazy {
+					token = c.Env["csrftokenfunc"].(func() string)()
+				} else {
+					token, _ = c.Env["csrftoken"].(string)
+				}
+				w.WriteHeader(200)
+			})
+			w := httptest.NewRecorder()
+			sm(&c, cm(&c, h)).ServeHTTP(w, r)
+			return w
+		}
+		r, _ := http.NewRequest("GET", "/form", nil)
+		w := serve(r)
+		if token == "" {
+			t.Fatalf("lazy %t: no token rendered for a fresh session", lazy)
+		}
+
+		// and the form is posted with it
+		r, _ = http.NewRequest("POST", "/form", strings.NewReader(CSRF_FIELD+"="+url.QueryEscape(token)))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, cookie := range w.Result().Cookies() {
+			r.AddCookie(cookie)
+		}
+		if w := serve(r); w.Code != 200 {
+			t.Fatalf("lazy %t: expected POST with the rendered token to succeed, have %d", lazy, w.Code)
+		}
+		sh.Close()
+	}
+}
@@ -0,0 +1,99 @@
+package base
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	// Session key for the fingerprint of the client the session was created for
+	FINGERPRINT_KEY = "_fingerprint"
+)
+
+/*
+FingerprintPolicy binds sessions to attributes of the client they were created for, making stolen
+session cookies harder to use.  Set it in SessionOptions.Fingerprint to turn it on.
+
+The fingerprint is a hash of the User-Agent header and, optionally, a prefix of the client's IP
+address.  It is recorded in the session when the session is created (or, for sessions created
+before fingerprinting was turned on, the first time they are seen), and checked on every request
+after that.
+
+Bear in mind that browser updates change the User-Agent, and mobile clients change IP address
+often, so either can log users out.  Using a short IP prefix such as a /16 reduces this.
+*/
+type FingerprintPolicy struct {
+	// Number of leading bits of a client's IPv4 address to include in the fingerprint. 0 leaves the address out
+	IPv4PrefixBits int
+	// Number of leading bits of a client's IPv6 address to include in the fingerprint. 0 leaves the address out
+	IPv6PrefixBits int
+	// ClientIP returns the client's IP address.  Defaults to the host part of r.RemoteAddr.  Set this
+	// if you are behind a proxy or load balancer
+	ClientIP func(r *http.Request) string
+	/*
+		OnMismatch is called instead of the handler when a session doesn't match the request.  The
+		session is still in c.Env["session"].  If OnMismatch is nil the session is destroyed and a new
+		one created, and the request continues with the new session.
+	*/
+	OnMismatch func(c *web.C, w http.ResponseWriter, r *http.Request)
+}
+
+/*
+Fingerprint returns the fingerprint of the client making the request
+*/
+func (p *FingerprintPolicy) Fingerprint(r *http.Request) string {
+	h := sha256.New()
+	h.Write([]byte(r.UserAgent()))
+	if prefix := p.ipPrefix(r); prefix != nil {
+		h.Write([]byte{0})
+		h.Write(prefix)
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// ipPrefix returns the leading bits of the client IP address, or nil if the address isn't used
+func (p *FingerprintPolicy) ipPrefix(r *http.Request) []byte {
+	var addr string
+	if p.ClientIP != nil {
+		addr = p.ClientIP(r)
+	} else {
+		addr = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if p.IPv4PrefixBits <= 0 {
+			return nil
+		}
+		return ip4.Mask(net.CIDRMask(p.IPv4PrefixBits, 32))
+	}
+	if p.IPv6PrefixBits <= 0 {
+		return nil
+	}
+	return ip.Mask(net.CIDRMask(p.IPv6PrefixBits, 128))
+}
+
+// record stores the fingerprint of the client in the session
+func (p *FingerprintPolicy) record(session *Session, r *http.Request) {
+	session.Put(FINGERPRINT_KEY, p.Fingerprint(r))
+}
+
+// matches checks the session was created for the client making the request.  Sessions without a
+// fingerprint have one recorded
+func (p *FingerprintPolicy) matches(session *Session, r *http.Request) bool {
+	stored, ok := session.Values[FINGERPRINT_KEY].(string)
+	if !ok {
+		p.record(session, r)
+		return true
+	}
+	return stored == p.Fingerprint(r)
+}
@@ -0,0 +1,108 @@
+package base
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+)
+
+func TestFingerprint(t *testing.T) {
+	p := &FingerprintPolicy{IPv4PrefixBits: 24}
+
+	r1, _ := http.NewRequest("GET", "/", nil)
+	r1.Header.Set("User-Agent", "cheese-browser/1.0")
+	r1.RemoteAddr = "10.1.2.3:1234"
+
+	r2, _ := http.NewRequest("GET", "/", nil)
+	r2.Header.Set("User-Agent", "cheese-browser/1.0")
+	r2.RemoteAddr = "10.1.2.200:5678"
+
+	if p.Fingerprint(r1) != p.Fingerprint(r2) {
+		t.Fatalf("fingerprints should match within the IP prefix")
+	}
+
+	r2.RemoteAddr = "10.1.3.3:1234"
+	if p.Fingerprint(r1) == p.Fingerprint(r2) {
+		t.Fatalf("fingerprints should differ outside the IP prefix")
+	}
+
+	p.IPv4PrefixBits = 0
+	if p.Fingerprint(r1) != p.Fingerprint(r2) {
+		t.Fatalf("fingerprints should ignore IP")
+	}
+
+	r2.Header.Set("User-Agent", "cracker-browser/2.0")
+	if p.Fingerprint(r1) == p.Fingerprint(r2) {
+		t.Fatalf("fingerprints should differ for different user agents")
+	}
+}
+
+func TestSessionMiddlewareFingerprint(t *testing.T) {
+	c := makeEnv()
+	sh := NewLimitedMemorySessionHolder(30, 0)
+	defer sh.Close()
+	m := BuildSessionMiddlewareWithOptions(sh, SessionOptions{Fingerprint: &FingerprintPolicy{}})
+
+	var session *Session
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ = SessionFromEnv(&c)
+	})
+
+	// The first request creates a session bound to the client
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "cheese-browser/1.0")
+	m(&c, h).ServeHTTP(httptest.NewRecorder(), r)
+	original := session
+
+	// The same client gets the same session
+	c = makeEnv()
+	r = requestForSession(original)
+	r.Header.Set("User-Agent", "cheese-browser/1.0")
+	m(&c, h).ServeHTTP(httptest.NewRecorder(), r)
+	if session.Id() != original.Id() {
+		t.Fatalf("expected the same session")
+	}
+
+	// A different client gets a new one, and the old one is destroyed
+	c = makeEnv()
+	r = requestForSession(original)
+	r.Header.Set("User-Agent", "cracker-browser/2.0")
+	m(&c, h).ServeHTTP(httptest.NewRecorder(), r)
+	if session.Id() == original.Id() {
+		t.Fatalf("expected a new session")
+	}
+	if _, err := sh.Get(c, requestForSession(original)); err != ErrorSessionNotFound {
+		t.Fatalf("expected original session to be destroyed, have %v", err)
+	}
+}
+
+func TestSessionMiddlewareFingerprintHandler(t *testing.T) {
+	c := makeEnv()
+	sh := NewLimitedMemorySessionHolder(30, 0)
+	defer sh.Close()
+	m := BuildSessionMiddlewareWithOptions(sh, SessionOptions{Fingerprint: &FingerprintPolicy{
+		OnMismatch: func(c *web.C, w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Who are you?", http.StatusUnauthorized)
+		},
+	}})
+
+	s := sh.Create(c)
+	s.Put(FINGERPRINT_KEY, "not-the-cheese-we-were-hoping-for")
+	sh.Save(c, s)
+
+	called := false
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	c = makeEnv()
+	w := httptest.NewRecorder()
+	m(&c, h).ServeHTTP(w, requestForSession(s))
+	if called {
+		t.Fatalf("handler should not be called on mismatch")
+	}
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected mismatch handler response, have %d", w.Code)
+	}
+}
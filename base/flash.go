@@ -0,0 +1,92 @@
+package base
+
+import (
+	"encoding/gob"
+)
+
+const (
+	// Session key under which flash messages are stored
+	FLASH_KEY = "_flashes"
+)
+
+func init() {
+	// Flashes are stored as a []interface{} of map[string]interface{}, so session
+	// stores that gob-encode the session need these registered
+	gob.Register([]interface{}{})
+	gob.Register(map[string]interface{}{})
+}
+
+// FlashCategory classifies a flash message
+type FlashCategory string
+
+const (
+	FlashInfo  FlashCategory = "info"
+	FlashWarn  FlashCategory = "warn"
+	FlashError FlashCategory = "error"
+)
+
+/*
+Flash is a message that is shown to the user once, typically on the page they are redirected to
+after submitting a form
+*/
+type Flash struct {
+	Category FlashCategory
+	Message  string
+}
+
+/*
+AddFlash adds a flash message to the session
+*/
+func (s *Session) AddFlash(category FlashCategory, message string) {
+	flashes, _ := s.Values[FLASH_KEY].([]interface{})
+	s.Put(FLASH_KEY, append(flashes, map[string]interface{}{
+		"category": string(category),
+		"message":  message,
+	}))
+}
+
+/*
+Flashes returns the flash messages in the session in the categories given, or all of them if no
+categories are given.  The messages returned are removed from the session.
+*/
+func (s *Session) Flashes(categories ...FlashCategory) []Flash {
+	stored, _ := s.Values[FLASH_KEY].([]interface{})
+	if len(stored) == 0 {
+		return nil
+	}
+
+	var flashes []Flash
+	var kept []interface{}
+	for _, f := range stored {
+		m, _ := f.(map[string]interface{})
+		category, _ := m["category"].(string)
+		message, _ := m["message"].(string)
+		flash := Flash{Category: FlashCategory(category), Message: message}
+		if flash.matches(categories) {
+			flashes = append(flashes, flash)
+		} else {
+			kept = append(kept, f)
+		}
+	}
+
+	if len(flashes) > 0 {
+		if len(kept) == 0 {
+			s.Del(FLASH_KEY)
+		} else {
+			s.Put(FLASH_KEY, kept)
+		}
+	}
+	return flashes
+}
+
+func (f Flash) matches(categories []FlashCategory) bool {
+	if len(categories) == 0 {
+		return true
+	}
+	for _, category := range categories {
+		if f.Category == category {
+			return true
+		}
+	}
+	return false
+}
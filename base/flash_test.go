@@ -0,0 +1,72 @@
+package base
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+)
+
+func TestFlashes(t *testing.T) {
+	c := makeEnv()
+	sh := NewBaseSessionHolder(30)
+	s := sh.Create(c)
+
+	if flashes := s.Flashes(); flashes != nil {
+		t.Fatalf("expected no flashes, have %v", flashes)
+	}
+
+	s.AddFlash(FlashInfo, "saved")
+	s.AddFlash(FlashError, "cheese missing")
+	s.AddFlash(FlashWarn, "running low on crackers")
+
+	s.SetDirty(false)
+	errors := s.Flashes(FlashError, FlashWarn)
+	exp := []Flash{{FlashError, "cheese missing"}, {FlashWarn, "running low on crackers"}}
+	if !reflect.DeepEqual(errors, exp) {
+		t.Fatalf("flashes not as expected. Have %v", errors)
+	}
+	if !s.IsDirty() {
+		t.Fatalf("reading flashes should mark the session dirty")
+	}
+
+	// Flashes are consumed when read
+	if errors := s.Flashes(FlashError); errors != nil {
+		t.Fatalf("expected flashes to be consumed, have %v", errors)
+	}
+
+	s.SetDirty(false)
+	if flashes := s.Flashes(FlashError); flashes != nil || s.IsDirty() {
+		t.Fatalf("reading no flashes should not mark the session dirty")
+	}
+
+	all := s.Flashes()
+	if !reflect.DeepEqual(all, []Flash{{FlashInfo, "saved"}}) {
+		t.Fatalf("flashes not as expected. Have %v", all)
+	}
+	if _, ok := s.Get(FLASH_KEY); ok {
+		t.Fatalf("expected flashes to be removed from session")
+	}
+}
+
+func TestFlashesGob(t *testing.T) {
+	c := makeEnv()
+	sh := NewBaseSessionHolder(30)
+	s := sh.Create(c)
+	s.AddFlash(FlashWarn, "mind the gap")
+
+	// The redis session store gob-encodes the whole session
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(s); err != nil {
+		t.Fatalf("could not encode session with flashes - %v", err)
+	}
+	var s1 Session
+	if err := gob.NewDecoder(&b).Decode(&s1); err != nil {
+		t.Fatalf("could not decode session with flashes - %v", err)
+	}
+
+	flashes := s1.Flashes()
+	if !reflect.DeepEqual(flashes, []Flash{{FlashWarn, "mind the gap"}}) {
+		t.Fatalf("flashes not as expected. Have %v", flashes)
+	}
+}
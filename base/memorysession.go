@@ -0,0 +1,320 @@
+package base
+
+import (
+	"container/list"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// memoryEntry is a session held by MemorySessionHolder
+type memoryEntry struct {
+	// Our own copy of the session
+	session *Session
+	// Our place in the LRU list
+	element *list.Element
+}
+
+/*
+MemorySessionHolder is an in-memory session holder.  It is safe for concurrent use, so is suitable
+for small single-instance deployments as well as testing.
+
+Sessions expire after Timeout seconds without being saved or having their TTL reset, or once they
+are MaxLifetime seconds old.  A background janitor removes sessions ExpiryGrace seconds after they
+expire.  It runs only while the holder has sessions, so if you finish with a holder that still
+has sessions, call Close() to stop it.  Set fields such as Timeout before saving any sessions.
+If a maximum number of entries is set, the least recently used sessions are dropped to keep within that limit.
+
+The holder keeps its own copy of each session, so requests never share mutable state.  Maps and
+slices of interface{} in the session values are copied, but other reference types (pointers,
+typed maps and slices) are shared, so treat them as immutable once Put() in a session.
+*/
+type MemorySessionHolder struct {
+	BaseSessionHolder
+
+	mu         sync.Mutex
+	maxEntries int
+	store      map[string]*memoryEntry
+	// Session Ids, most recently used first
+	lru *list.List
+	// Is the janitor running, and has the holder been closed?
+	janitorRunning bool
+	closed         bool
+	stop           chan struct{}
+}
+
+/*
+NewMemorySessionHolder creates an in-memory session holder with no limit on the number of sessions
+*/
+func NewMemorySessionHolder(timeout int) SessionHolder {
+	return NewLimitedMemorySessionHolder(timeout, 0)
+}
+
+/*
+NewLimitedMemorySessionHolder creates an in-memory session holder that keeps at most maxEntries
+sessions.  0 means there is no limit.
+*/
+func NewLimitedMemorySessionHolder(timeout int, maxEntries int) *MemorySessionHolder {
+	sh := &MemorySessionHolder{
+		BaseSessionHolder: NewBaseSessionHolder(timeout),
+		maxEntries:        maxEntries,
+		store:             make(map[string]*memoryEntry),
+		lru:               list.New(),
+		stop:              make(chan struct{}),
+	}
+	return sh
+}
+
+/*
+Close stops the background janitor.  Expired sessions are no longer removed, except by calling
+RemoveExpired
+*/
+func (sh *MemorySessionHolder) Close() {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if !sh.closed {
+		sh.closed = true
+		close(sh.stop)
+	}
+}
+
+/*
+Len returns the number of sessions held, including any that have expired but have not yet been removed
+*/
+func (sh *MemorySessionHolder) Len() int {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return len(sh.store)
+}
+
+func (sh *MemorySessionHolder) Get(c web.C, r *http.Request) (*Session, error) {
+	sessionId := sh.GetSessionId(r)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	entry, ok := sh.store[sessionId]
+	if !ok {
+		return nil, ErrorSessionNotFound
+	}
+	if err := sh.CheckExpiry(entry.session, time.Now()); err != nil {
+		return copySession(entry.session), err
+	}
+	sh.lru.MoveToFront(entry.element)
+	return copySession(entry.session), nil
+}
+
+func (sh *MemorySessionHolder) Destroy(c web.C, session *Session) error {
+	sh.mu.Lock()
+	if entry, ok := sh.store[session.Id()]; ok {
+		sh.remove(entry)
+	}
+	sh.mu.Unlock()
+	delete(c.Env, "session")
+	return nil
+}
+
+/*
+Save a session.  Returns ErrorSessionConflict if the stored session has been saved since this
+one was loaded, and ErrorSessionNotFound if it has been destroyed since, so a request that was
+running when the session was revoked doesn't bring it back
+*/
+func (sh *MemorySessionHolder) Save(c web.C, session *Session) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	entry, ok := sh.store[session.Id()]
+	if !ok && session.Version > 0 {
+		return ErrorSessionNotFound
+	}
+	if ok && entry.session.Version != session.Version {
+		return ErrorSessionConflict
+	}
+
+	session.LastAccess = time.Now()
+	session.Version++
+	sh.put(copySession(session))
+	return nil
+}
+
+/*
+Regenerate the session id of an existing session.  The stored session is moved to the new id, so
+changes not yet saved are not stored.  Returns ErrorSessionNotFound if the session has been
+destroyed since it was loaded
+*/
+func (sh *MemorySessionHolder) RegenerateId(_ web.C, session *Session) (string, error) {
+	newSessionId := sh.GenerateSessionId()
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	entry, ok := sh.store[session.Id()]
+	if !ok && session.Version > 0 {
+		return session.Id(), ErrorSessionNotFound
+	}
+	session.SetId(newSessionId)
+	if ok {
+		// A session that hasn't been saved yet is stored under its new id when it is
+		sh.remove(entry)
+		entry.session.SetId(newSessionId)
+		sh.put(entry.session)
+	}
+	return newSessionId, nil
+}
+
+func (sh *MemorySessionHolder) ResetTTL(_ web.C, session *Session) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	session.LastAccess = time.Now()
+	if entry, ok := sh.store[session.Id()]; ok {
+		entry.session.LastAccess = session.LastAccess
+	}
+	return nil
+}
+
+/*
+BindUser records that session belongs to userId, and saves it
+*/
+func (sh *MemorySessionHolder) BindUser(c web.C, r *http.Request, session *Session, userId string) error {
+	session.SetUser(userId, r.UserAgent())
+	return sh.Save(c, session)
+}
+
+/*
+UserSessions lists the user's sessions that have not expired, most recently used first
+*/
+func (sh *MemorySessionHolder) UserSessions(_ web.C, userId string) ([]SessionInfo, error) {
+	now := time.Now()
+	sh.mu.Lock()
+	var infos []SessionInfo
+	for _, entry := range sh.store {
+		if entry.session.UserId == userId && sh.CheckExpiry(entry.session, now) == nil {
+			infos = append(infos, entry.session.Info())
+		}
+	}
+	sh.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].LastAccess.After(infos[j].LastAccess) })
+	return infos, nil
+}
+
+/*
+DestroyUserSessions destroys all the user's sessions
+*/
+func (sh *MemorySessionHolder) DestroyUserSessions(c web.C, userId string) error {
+	sh.mu.Lock()
+	for _, entry := range sh.store {
+		if entry.session.UserId == userId {
+			sh.remove(entry)
+		}
+	}
+	sh.mu.Unlock()
+
+	if session, ok := SessionFromEnv(&c); ok && session.UserId == userId {
+		delete(c.Env, "session")
+	}
+	return nil
+}
+
+/*
+RemoveExpired removes all sessions that expired more than ExpiryGrace seconds ago, returning the
+number removed.  The janitor calls this periodically
+*/
+func (sh *MemorySessionHolder) RemoveExpired() int {
+	now := time.Now().Add(-time.Duration(sh.ExpiryGrace) * time.Second)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	count := 0
+	for _, entry := range sh.store {
+		if sh.CheckExpiry(entry.session, now) != nil {
+			sh.remove(entry)
+			count++
+		}
+	}
+	return count
+}
+
+func (sh *MemorySessionHolder) janitor() {
+	interval := time.Duration(sh.Timeout) * time.Second / 2
+	if interval < time.Second {
+		interval = time.Second
+	} else if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sh.RemoveExpired()
+			// Stop when there's nothing left to remove.  put starts us again
+			sh.mu.Lock()
+			if len(sh.store) == 0 {
+				sh.janitorRunning = false
+				sh.mu.Unlock()
+				return
+			}
+			sh.mu.Unlock()
+		case <-sh.stop:
+			return
+		}
+	}
+}
+
+// put stores a session, replacing any existing one with the same Id. Call with the lock held
+func (sh *MemorySessionHolder) put(session *Session) {
+	if entry, ok := sh.store[session.Id()]; ok {
+		entry.session = session
+		sh.lru.MoveToFront(entry.element)
+		return
+	}
+
+	sh.store[session.Id()] = &memoryEntry{
+		session: session,
+		element: sh.lru.PushFront(session.Id()),
+	}
+	if !sh.janitorRunning && !sh.closed {
+		sh.janitorRunning = true
+		go sh.janitor()
+	}
+	for sh.maxEntries > 0 && len(sh.store) > sh.maxEntries {
+		sh.remove(sh.store[sh.lru.Back().Value.(string)])
+	}
+}
+
+// remove drops an entry. Call with the lock held
+func (sh *MemorySessionHolder) remove(entry *memoryEntry) {
+	sh.lru.Remove(entry.element)
+	delete(sh.store, entry.session.Id())
+}
+
+// copySession makes a clean copy of a session that shares no maps or []interface{} with the original
+func copySession(session *Session) *Session {
+	return &Session{
+		id:         session.id,
+		Values:     copyValue(session.Values).(map[string]interface{}),
+		Created:    session.Created,
+		LastAccess: session.LastAccess,
+		UserId:     session.UserId,
+		UserAgent:  session.UserAgent,
+		Version:    session.Version,
+	}
+}
+
+func copyValue(val interface{}) interface{} {
+	switch val := val.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, v := range val {
+			m[k] = copyValue(v)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(val))
+		for i, v := range val {
+			s[i] = copyValue(v)
+		}
+		return s
+	}
+	return val
+}
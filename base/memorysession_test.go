@@ -0,0 +1,159 @@
+package base
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func requestForSession(s *Session) *http.Request {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sessionid", Value: s.Id()})
+	return r
+}
+
+func TestMemorySessionCopies(t *testing.T) {
+	c := makeEnv()
+	sh := NewLimitedMemorySessionHolder(30, 0)
+	defer sh.Close()
+
+	s := sh.Create(c)
+	s.Put("basket", []interface{}{"apple"})
+	sh.Save(c, s)
+
+	// Changes after saving don't affect the stored session
+	s.Put("cheese", "edam")
+	s.Values["basket"].([]interface{})[0] = "pear"
+
+	s1, err := sh.Get(c, requestForSession(s))
+	if err != nil {
+		t.Fatalf("failed to get session - %v", err)
+	}
+	if s1 == s {
+		t.Fatalf("expected a copy of the session")
+	}
+	if _, ok := s1.Get("cheese"); ok {
+		t.Fatalf("unsaved change visible in stored session")
+	}
+	if fruit := s1.Values["basket"].([]interface{})[0]; fruit != "apple" {
+		t.Fatalf("stored session shares slice with saved session. Have %v", fruit)
+	}
+	if s1.IsDirty() {
+		t.Fatalf("session from store should not be dirty")
+	}
+}
+
+func TestMemorySessionExpiry(t *testing.T) {
+	c := makeEnv()
+	sh := NewLimitedMemorySessionHolder(1, 0)
+	defer sh.Close()
+	sh.ExpiryGrace = 0
+
+	s := sh.Create(c)
+	sh.Save(c, s)
+	expired := sh.Create(c)
+	sh.Save(c, expired)
+
+	time.Sleep(600 * time.Millisecond)
+	sh.ResetTTL(c, s)
+	time.Sleep(600 * time.Millisecond)
+
+	if _, err := sh.Get(c, requestForSession(s)); err != nil {
+		t.Fatalf("session with TTL reset should not have expired - %v", err)
+	}
+	// The janitor may have got here first
+	sh.RemoveExpired()
+	if sh.Len() != 1 {
+		t.Fatalf("expected expired session to be removed, have %d sessions", sh.Len())
+	}
+	if _, err := sh.Get(c, requestForSession(expired)); err != ErrorSessionNotFound {
+		t.Fatalf("expected session to have expired, got %v", err)
+	}
+}
+
+func TestMemorySessionJanitor(t *testing.T) {
+	c := makeEnv()
+	sh := NewLimitedMemorySessionHolder(1, 0)
+	defer sh.Close()
+	running := func() bool {
+		sh.mu.Lock()
+		defer sh.mu.Unlock()
+		return sh.janitorRunning
+	}
+
+	if running() {
+		t.Fatalf("janitor should not run for an empty holder")
+	}
+	s := sh.Create(c)
+	sh.Save(c, s)
+	if !running() {
+		t.Fatalf("janitor should run once there are sessions")
+	}
+
+	// Once the holder is empty the janitor stops at its next tick
+	sh.Destroy(c, s)
+	time.Sleep(1500 * time.Millisecond)
+	if running() {
+		t.Fatalf("janitor should stop when there are no sessions")
+	}
+}
+
+func TestMemorySessionLRU(t *testing.T) {
+	c := makeEnv()
+	sh := NewLimitedMemorySessionHolder(30, 2)
+	defer sh.Close()
+
+	s1 := sh.Create(c)
+	sh.Save(c, s1)
+	s2 := sh.Create(c)
+	sh.Save(c, s2)
+
+	// Use s1 so s2 is least recently used
+	sh.Get(c, requestForSession(s1))
+
+	s3 := sh.Create(c)
+	sh.Save(c, s3)
+
+	if sh.Len() != 2 {
+		t.Fatalf("expected 2 sessions, have %d", sh.Len())
+	}
+	if _, err := sh.Get(c, requestForSession(s2)); err != ErrorSessionNotFound {
+		t.Fatalf("expected least recently used session to be dropped")
+	}
+	for _, s := range []*Session{s1, s3} {
+		if _, err := sh.Get(c, requestForSession(s)); err != nil {
+			t.Fatalf("expected session %s to be kept - %v", s.Id(), err)
+		}
+	}
+}
+
+func TestMemorySessionConcurrent(t *testing.T) {
+	sh := NewLimitedMemorySessionHolder(30, 50)
+	defer sh.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := makeEnv()
+			s := sh.Create(c)
+			for j := 0; j < 100; j++ {
+				s.Put("count", fmt.Sprintf("%d-%d", i, j))
+				sh.Save(c, s)
+				s1, err := sh.Get(c, requestForSession(s))
+				if err == nil {
+					s1.Put("scratch", j)
+					sh.ResetTTL(c, s1)
+				}
+				if j%10 == 0 {
+					sh.RegenerateId(c, s)
+				}
+			}
+			sh.Destroy(c, s)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -1,28 +1,48 @@
 package base
 
 import (
-	crand "crypto/rand"
 	"errors"
 	"log"
-	"math/big"
 	"math/rand"
 	"net/http"
-	"strconv"
+	"strings"
+	"time"
 
 	"github.com/zenazn/goji/web"
 )
 
 var (
 	ErrorSessionNotFound error = errors.New("No session found matching that Id")
+	ErrorSessionExpired  error = errors.New("Session has expired")
+	ErrorSessionConflict error = errors.New("Session was saved by another request since it was loaded")
+	ErrorCookiePrefix    error = errors.New("Cookie name must not include a __Host- or __Secure- prefix. Use CookieOptions.Prefix")
+	ErrorHostPrefix      error = errors.New("__Host- cookies must have Path / and no Domain")
 )
 
 /*
 Session represents a web session
 */
 type Session struct {
-	id     string
-	dirty  bool
-	Values map[string]interface{}
+	id    string
+	dirty bool
+	// The whole session needs saving, not just the changes
+	whole bool
+	// Created lazily by the session middleware, so not saved unless something is put in it
+	lazy bool
+	// Keys Put (true) or Del'd (false) since the session was loaded or saved
+	changes map[string]bool
+	Values  map[string]interface{}
+	// When the session was created
+	Created time.Time
+	// When the session was last saved or had its TTL reset
+	LastAccess time.Time
+	// The user the session belongs to, if any.  See UserSessionIndex
+	UserId string
+	// User-Agent of the client when the session was bound to the user
+	UserAgent string
+	// Version of the session in the store.  It is incremented each time the session is saved, and
+	// is 0 for sessions that have never been saved
+	Version int64
 }
 
 /*
@@ -45,10 +65,34 @@ func (s *Session) IsDirty() bool {
 
 /*
 Set whether this Session is dirty.  Normally this is done automatically
-by Put
+by Put.  Setting it dirty means the whole session should be saved, and
+setting it clean forgets the changes made
 */
 func (s *Session) SetDirty(dirty bool) {
 	s.dirty = dirty
+	s.whole = dirty
+	s.changes = nil
+}
+
+/*
+Changes returns the keys Put (true) or Del'd (false) since the session was loaded or last saved.
+partial is false if the whole session needs saving, for example because it is new or was marked
+dirty with SetDirty.  SessionHolders that can save part of a session use this.
+*/
+func (s *Session) Changes() (changes map[string]bool, partial bool) {
+	return s.changes, !s.whole
+}
+
+// changed records a change to key
+func (s *Session) changed(key string, put bool) {
+	s.dirty = true
+	if s.whole {
+		return
+	}
+	if s.changes == nil {
+		s.changes = make(map[string]bool)
+	}
+	s.changes[key] = put
 }
 
 /*
@@ -64,6 +108,16 @@ Save a value in the Session
 */
 func (s *Session) Put(key string, value interface{}) {
 	s.Values[key] = value
+	s.changed(key, true)
+}
+
+/*
+SetUser records the user that owns the session and the User-Agent of their client.  Use
+UserSessionIndex.BindUser rather than calling this directly if the SessionHolder supports it
+*/
+func (s *Session) SetUser(userId, userAgent string) {
+	s.UserId = userId
+	s.UserAgent = userAgent
 	s.dirty = true
 }
 
@@ -72,7 +126,7 @@ Delete a value from the session
 */
 func (s *Session) Del(key string) {
 	delete(s.Values, key)
-	s.dirty = true
+	s.changed(key, false)
 }
 
 /*
@@ -82,7 +136,9 @@ type SessionHolder interface {
 	/*
 	   Get the session associated with the current request, if there is one.
 
-	   Return ErrorSessionNotFound if there is no matching session
+	   Return ErrorSessionNotFound if there is no matching session.  Return ErrorSessionExpired
+	   if the session has passed its idle timeout or maximum lifetime, along with the expired
+	   session if it is available so that it can be destroyed
 	*/
 	Get(c web.C, r *http.Request) (*Session, error)
 
@@ -102,6 +158,9 @@ type SessionHolder interface {
 
 	/*
 	   Save a session
+
+	   Holders that support optimistic concurrency return ErrorSessionConflict if the stored
+	   session's Version is not session.Version, and increment session.Version when they save it
 	*/
 	Save(c web.C, session *Session) error
 
@@ -133,30 +192,101 @@ type SessionHolder interface {
 	ResetTTL(c web.C, session *Session) error
 }
 
+/*
+MaxLifetimeSetter is implemented by SessionHolders that can limit how long a session lasts,
+however active it is, including those built on BaseSessionHolder.  It is separate from
+SessionHolder so that existing implementations still satisfy that.
+*/
+type MaxLifetimeSetter interface {
+	/* SetMaxLifetime sets the maximum lifetime of a session, however active it is */
+	SetMaxLifetime(maxLifetime int)
+
+	/* GetMaxLifetime retrieves the currently set maximum session lifetime */
+	GetMaxLifetime() int
+}
+
+/*
+CookieOptionsSetter is implemented by SessionHolders whose session cookie can be configured,
+including those built on BaseSessionHolder.  It is separate from SessionHolder so that existing
+implementations still satisfy that.
+*/
+type CookieOptionsSetter interface {
+	/* SetCookieOptions sets the name, domain, path and prefix of the session cookie */
+	SetCookieOptions(opts CookieOptions) error
+}
+
+/*
+CookiePrefix is a cookie name prefix that tells browsers to enforce restrictions on the cookie
+*/
+type CookiePrefix string
+
+const (
+	NoPrefix CookiePrefix = ""
+	// The cookie must be Secure, have Path "/" and no Domain, so it is only sent to the host that set it
+	HostPrefix CookiePrefix = "__Host-"
+	// The cookie must be Secure
+	SecurePrefix CookiePrefix = "__Secure-"
+)
+
+/*
+CookieOptions controls the name and scope of the session cookie
+*/
+type CookieOptions struct {
+	// Cookie name, without any prefix. Defaults to "sessionid"
+	Name string
+	// Domain for the cookie.  Leave empty for a host-only cookie
+	Domain string
+	// Path for the cookie.  Defaults to "/"
+	Path string
+	// Prefix asks the browser to enforce restrictions on the cookie.  Setting a prefix forces
+	// the cookie to be Secure
+	Prefix CookiePrefix
+}
+
+const (
+	// Default for BaseSessionHolder.ExpiryGrace, in seconds
+	DEFAULT_EXPIRY_GRACE = 24 * 60 * 60
+)
+
 /*
 BaseSessionHolder is a building block you can use to build a SessionHolder implementation
 */
 type BaseSessionHolder struct {
-	Timeout          int
+	// Idle timeout in seconds.  Sessions expire if they are not accessed for this long
+	Timeout int
+	// Maximum lifetime of sessions in seconds, however active they are.  0 means no limit
+	MaxLifetime int
+	// How long in seconds to keep sessions after they expire, so that Get can report
+	// ErrorSessionExpired rather than ErrorSessionNotFound.  This also extends the
+	// lifetime of persistent cookies, so that the browser still sends them: with the
+	// default, DEFAULT_EXPIRY_GRACE, a cookie's Max-Age is a day longer than the session's
+	// timeout.  Set it to 0 to remove sessions, and their cookies, as soon as they expire
+	ExpiryGrace int
+	// Generates session IDs, and checks those sent by clients.  Defaults to 32 random bytes
+	// in unpadded base64url.  IDs from earlier versions, which were base36, fail the check, so
+	// upgrading logs out every existing user unless you set a generator that accepts them
+	IdGenerator IDGenerator
+	// Deprecated: session IDs now come from IdGenerator, and RandSource is ignored
 	RandSource       rand.Source
 	HttpOnly         bool
 	Secure           bool
 	SameSite         http.SameSite
 	PersistentCookie bool
+	Cookie           CookieOptions
 }
 
 func NewBaseSessionHolder(timeout int) BaseSessionHolder {
-	seed, err := crand.Int(crand.Reader, big.NewInt(0x7FFFFFFFFFFFFFFF))
-	if err != nil {
-		log.Panicf("Could not get a random seed for session generation, %v", err)
-	}
-
 	return BaseSessionHolder{
 		Timeout:          timeout,
-		RandSource:       rand.NewSource(seed.Int64()),
+		ExpiryGrace:      DEFAULT_EXPIRY_GRACE,
+		IdGenerator:      NewRandomIdGenerator(DEFAULT_SESSION_ID_BYTES, Base64URLEncoding),
 		HttpOnly:         false,
 		Secure:           false,
 		PersistentCookie: true,
+		Cookie: CookieOptions{
+			Name: "sessionid",
+			Path: "/",
+		},
 	}
 }
 
@@ -164,10 +294,14 @@ func NewBaseSessionHolder(timeout int) BaseSessionHolder {
 Create builds a session object, adds it to c.Env["session"] and marks it as dirty
 */
 func (sh *BaseSessionHolder) Create(c web.C) *Session {
+	now := time.Now()
 	session := &Session{
-		id:     sh.GenerateSessionId(),
-		Values: make(map[string]interface{}, 0),
-		dirty:  true,
+		id:         sh.GenerateSessionId(),
+		Values:     make(map[string]interface{}, 0),
+		dirty:      true,
+		whole:      true,
+		Created:    now,
+		LastAccess: now,
 	}
 	c.Env["session"] = session
 	return session
@@ -176,11 +310,24 @@ func (sh *BaseSessionHolder) Create(c web.C) *Session {
 /*
 GetSessionId extracts the session ID from a request if one is present.
 
+IDs that could not have been generated by the IdGenerator are ignored, so junk from clients
+never reaches the session store.  This includes the base36 IDs issued by earlier versions, so
+their sessions are no longer found.
+
 Note this is not part of the SessionHolder interface - it is intended to
 be used as a building block by SessionHolder implementations
 */
 func (sh *BaseSessionHolder) GetSessionId(r *http.Request) string {
-	cookie, err := r.Cookie("sessionid")
+	sessionId := sh.getCookieValue(r)
+	if sessionId == "" || !sh.idGenerator().ValidId(sessionId) {
+		return ""
+	}
+	return sessionId
+}
+
+// getCookieValue returns the raw value of the session cookie in the request
+func (sh *BaseSessionHolder) getCookieValue(r *http.Request) string {
+	cookie, err := r.Cookie(sh.cookieName())
 	if err != nil {
 		return ""
 	}
@@ -193,12 +340,23 @@ GenerateSessionId generates an id that can be used as sessionid
 Note this is not part of the SessionHolder interface - it is intended to
 be used as a building block by SessionHolder implementations
 */
-
 func (sh *BaseSessionHolder) GenerateSessionId() string {
-	a := uint64(sh.RandSource.Int63())
-	b := uint64(sh.RandSource.Int63())
+	return sh.idGenerator().GenerateId()
+}
+
+/*
+SetIdGenerator changes how session IDs are generated and validated.  Sessions with IDs that
+don't pass the new generator's validation will no longer be found
+*/
+func (sh *BaseSessionHolder) SetIdGenerator(g IDGenerator) {
+	sh.IdGenerator = g
+}
 
-	return strconv.FormatUint(a, 36) + strconv.FormatUint(b, 36)
+func (sh *BaseSessionHolder) idGenerator() IDGenerator {
+	if sh.IdGenerator == nil {
+		return defaultIdGenerator
+	}
+	return sh.IdGenerator
 }
 
 /*
@@ -218,6 +376,104 @@ func (sh *BaseSessionHolder) SetTimeout(timeout int) {
 	sh.Timeout = timeout
 }
 
+/*
+GetMaxLifetime retrieves the maximum lifetime for sessions
+*/
+func (sh *BaseSessionHolder) GetMaxLifetime() int {
+	return sh.MaxLifetime
+}
+
+/*
+SetMaxLifetime sets the maximum lifetime for sessions in seconds.  Sessions older than this expire
+even if they are in use.  0 means there is no maximum
+*/
+func (sh *BaseSessionHolder) SetMaxLifetime(maxLifetime int) {
+	sh.MaxLifetime = maxLifetime
+}
+
+/*
+ExpiresAt returns when session expires if it is accessed at accessed.  This is the earlier of the
+idle timeout and the maximum lifetime.  Returns the zero time if the session never expires.
+
+Note this is not part of the SessionHolder interface - it is intended to
+be used as a building block by SessionHolder implementations
+*/
+func (sh *BaseSessionHolder) ExpiresAt(session *Session, accessed time.Time) time.Time {
+	var expires time.Time
+	if sh.Timeout > 0 {
+		expires = accessed.Add(time.Duration(sh.Timeout) * time.Second)
+	}
+	if sh.MaxLifetime > 0 && !session.Created.IsZero() {
+		limit := session.Created.Add(time.Duration(sh.MaxLifetime) * time.Second)
+		if expires.IsZero() || limit.Before(expires) {
+			expires = limit
+		}
+	}
+	return expires
+}
+
+/*
+SessionTTL returns the number of seconds until session expires, if it is accessed now.  Returns 0
+if the session never expires.
+
+Note this is not part of the SessionHolder interface - it is intended to
+be used as a building block by SessionHolder implementations
+*/
+func (sh *BaseSessionHolder) SessionTTL(session *Session, now time.Time) int {
+	expires := sh.ExpiresAt(session, now)
+	if expires.IsZero() {
+		return 0
+	}
+	ttl := int(expires.Sub(now) / time.Second)
+	if ttl < 1 {
+		// Already past its maximum lifetime
+		ttl = 1
+	}
+	return ttl
+}
+
+/*
+StoreTTL returns how many seconds a session store should keep session if it is accessed now.  This
+is the SessionTTL plus ExpiryGrace.  Returns 0 if the session should be kept forever.
+
+Note this is not part of the SessionHolder interface - it is intended to
+be used as a building block by SessionHolder implementations
+*/
+func (sh *BaseSessionHolder) StoreTTL(session *Session, now time.Time) int {
+	ttl := sh.SessionTTL(session, now)
+	if ttl == 0 {
+		return 0
+	}
+	return ttl + sh.ExpiryGrace
+}
+
+/*
+CheckExpiry returns ErrorSessionExpired if session, last accessed at session.LastAccess, has expired
+by now.
+
+If there is a MaxLifetime and the session was stored before creation times were recorded, its
+lifetime starts now: Created is set and the session marked dirty so that it is saved.
+
+Note this is not part of the SessionHolder interface - it is intended to
+be used as a building block by SessionHolder implementations
+*/
+func (sh *BaseSessionHolder) CheckExpiry(session *Session, now time.Time) error {
+	if sh.MaxLifetime > 0 && session.Created.IsZero() {
+		session.Created = now
+		session.SetDirty(true)
+	}
+	accessed := session.LastAccess
+	if accessed.IsZero() {
+		// Sessions stored before we recorded access times
+		accessed = now
+	}
+	expires := sh.ExpiresAt(session, accessed)
+	if !expires.IsZero() && now.After(expires) {
+		return ErrorSessionExpired
+	}
+	return nil
+}
+
 /*
 SetHTTPOnly allows setting/unsetting of HTTP only secured cookies
 */
@@ -237,83 +493,106 @@ func (sh *BaseSessionHolder) SetSameSite(ss http.SameSite) {
 }
 
 /*
-SetPersistentCookies allows switching between persistent time out based cookies (MaxAge) and session lifetime cookies (no MaxAge)
-*/
-func (sh *BaseSessionHolder) SetPersistentCookies(persistent bool) {
-	sh.PersistentCookie = persistent
-}
+SetCookieOptions sets the name, domain, path and prefix of the session cookie.
 
-/*
-Add the Session to the response
-
-Basically this means setting a cookie
+The options are checked with Validate, and an error returned if the cookie would be rejected.
+Setting a prefix also turns on Secure.
 */
-func (sh *BaseSessionHolder) AddToResponse(c web.C, session *Session, w http.ResponseWriter) {
-	cookie := http.Cookie{
-		Name:     "sessionid",
-		Value:    session.Id(),
-		Path:     "/",
-		HttpOnly: sh.HttpOnly,
-		Secure:   sh.Secure,
-		SameSite: sh.SameSite,
+func (sh *BaseSessionHolder) SetCookieOptions(opts CookieOptions) error {
+	if opts.Name == "" {
+		opts.Name = "sessionid"
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
 	}
-	if sh.PersistentCookie {
-		cookie.MaxAge = sh.Timeout
+	if err := opts.Validate(); err != nil {
+		return err
 	}
-	http.SetCookie(w, &cookie)
+	if opts.Prefix != NoPrefix {
+		sh.Secure = true
+	}
+	sh.Cookie = opts
+	return nil
 }
 
 /*
-MemorySessionHolder is an in-memory session holder.  Only really useful for testing
+Validate checks the options against the restrictions browsers enforce for the prefix, returning
+an error if they would cause the cookie to be rejected.  An empty Path is taken to be "/".
+BuildSessionMiddleware logs the error for holders built on BaseSessionHolder, so options set
+directly in the Cookie field are checked too.  __Host- cookies are then sent with Path / and no
+Domain regardless.
 */
-type MemorySessionHolder struct {
-	BaseSessionHolder
-	store map[string]*Session
+func (opts CookieOptions) Validate() error {
+	if strings.HasPrefix(opts.Name, string(HostPrefix)) || strings.HasPrefix(opts.Name, string(SecurePrefix)) {
+		return ErrorCookiePrefix
+	}
+	if opts.Prefix == HostPrefix && ((opts.Path != "" && opts.Path != "/") || opts.Domain != "") {
+		return ErrorHostPrefix
+	}
+	return nil
 }
 
-func NewMemorySessionHolder(timeout int) SessionHolder {
-	return &MemorySessionHolder{
-		BaseSessionHolder: NewBaseSessionHolder(timeout),
-		store:             make(map[string]*Session, 0),
-	}
+// cookieOptions returns the cookie options.  Used by BuildSessionMiddleware to check them
+func (sh *BaseSessionHolder) cookieOptions() CookieOptions {
+	return sh.Cookie
 }
 
-func (sh *MemorySessionHolder) Get(c web.C, r *http.Request) (*Session, error) {
-	sessionId := sh.GetSessionId(r)
-	session, ok := sh.store[sessionId]
-	if !ok {
-		return nil, ErrorSessionNotFound
+func (sh *BaseSessionHolder) cookieName() string {
+	name := sh.Cookie.Name
+	if name == "" {
+		name = "sessionid"
 	}
-	return session, nil
+	return string(sh.Cookie.Prefix) + name
 }
 
-func (sh *MemorySessionHolder) Destroy(c web.C, session *Session) error {
-	delete(sh.store, session.Id())
-	delete(c.Env, "session")
-	return nil
+/*
+SetPersistentCookies allows switching between persistent time out based cookies (MaxAge) and session lifetime cookies (no MaxAge)
+*/
+func (sh *BaseSessionHolder) SetPersistentCookies(persistent bool) {
+	sh.PersistentCookie = persistent
 }
 
 /*
-   Save a session
+Add the Session to the response
+
+Basically this means setting a cookie.  A persistent cookie lasts as long as the session is
+stored, which is ExpiryGrace longer than the session lasts
 */
-func (sh *MemorySessionHolder) Save(c web.C, session *Session) error {
-	sh.store[session.Id()] = session
-	return nil
+func (sh *BaseSessionHolder) AddToResponse(c web.C, session *Session, w http.ResponseWriter) {
+	http.SetCookie(w, sh.sessionCookie(session.Id(), sh.StoreTTL(session, time.Now())))
 }
 
 /*
-   Regenerate the session id of an existing session.
+RemoveFromResponse tells the client to discard the session cookie.
+
+Note this is not part of the SessionHolder interface. BuildSessionMiddleware uses it
+when a session is destroyed during a request
 */
-func (sh *MemorySessionHolder) RegenerateId(_ web.C, session *Session) (string, error) {
-	newSessionId := sh.GenerateSessionId()
-	delete(sh.store, session.Id())
-	session.SetId(newSessionId)
-	sh.store[newSessionId] = session
-	return newSessionId, nil
+func (sh *BaseSessionHolder) RemoveFromResponse(c web.C, w http.ResponseWriter) {
+	http.SetCookie(w, sh.sessionCookie("", -1))
 }
 
-func (sh *MemorySessionHolder) ResetTTL(_ web.C, session *Session) error {
-	return nil
+// sessionCookie builds the session cookie carrying value.  maxAge is used if the cookie is persistent, or negative
+func (sh *BaseSessionHolder) sessionCookie(value string, maxAge int) *http.Cookie {
+	path, domain := sh.Cookie.Path, sh.Cookie.Domain
+	if path == "" || sh.Cookie.Prefix == HostPrefix {
+		// Browsers reject __Host- cookies with any other Path, or a Domain
+		path, domain = "/", ""
+	}
+	cookie := &http.Cookie{
+		Name:     sh.cookieName(),
+		Value:    value,
+		Path:     path,
+		Domain:   domain,
+		HttpOnly: sh.HttpOnly,
+		// Browsers reject prefixed cookies that aren't Secure
+		Secure:   sh.Secure || sh.Cookie.Prefix != NoPrefix,
+		SameSite: sh.SameSite,
+	}
+	if sh.PersistentCookie || maxAge < 0 {
+		cookie.MaxAge = maxAge
+	}
+	return cookie
 }
 
 // SessionFromEnv() retrieves the session from the Goji context
@@ -325,6 +604,12 @@ func SessionFromEnv(c *web.C) (*Session, bool) {
 	return nil, false
 }
 
+// SessionExpiredFromEnv() returns true if the request came with a session that had expired
+func SessionExpiredFromEnv(c *web.C) bool {
+	expired, _ := c.Env["sessionexpired"].(bool)
+	return expired
+}
+
 // SessionHolderFromEnv() retrieves the session holder from the Goji context
 func SessionHolderFromEnv(c *web.C) (SessionHolder, bool) {
 	sh, ok := c.Env["sessionholder"]
@@ -345,12 +630,60 @@ func Logout(c *web.C) {
 	}
 }
 
+/*
+SavePolicy controls when BuildSessionMiddlewareWithOptions saves sessions
+*/
+type SavePolicy int
+
+const (
+	// SaveUnlessPanic saves the session unless the handler panics.  This is the default
+	SaveUnlessPanic SavePolicy = iota
+	// SaveAlways saves the session even if the handler panics
+	SaveAlways
+	// SaveOnSuccess saves the session only if the handler doesn't panic and the response status is not 5xx
+	SaveOnSuccess
+)
+
+/*
+SessionOptions controls the behaviour of the middleware built by BuildSessionMiddlewareWithOptions
+*/
+type SessionOptions struct {
+	/*
+		LazyCreate stops the middleware creating a stored session for every request that doesn't have one.
+		Instead a new, clean session is put in c.Env["session"], and it is only saved and sent to the
+		client in a cookie once something is Put() in it.  This saves filling the session store with
+		empty sessions for bots, health checks and static assets.
+
+		Note that the value must be Put() before the handler starts writing the response, otherwise it
+		is too late to set the cookie.
+	*/
+	LazyCreate bool
+
+	// SavePolicy controls whether the session is saved if the handler panics or fails
+	SavePolicy SavePolicy
+
+	// Fingerprint, if set, binds sessions to the client they were created for.  See FingerprintPolicy
+	Fingerprint *FingerprintPolicy
+
+	// OnConflict is called when a session can't be saved because another request saved it first.
+	// Defaults to MergeChanges
+	OnConflict ConflictHandler
+}
+
 /*
 BuildSessionMiddleware builds middleware with the provided SessionHolder.  The middleware
 
  - adds the SessionHolder to c.Env["sessionholder"] so application code can create and delete sessions
- - finds the session associated with the request (if any) and puts it in c.Env["session"]
- - saves the session if dirty and the request is processed without a panic
+ - finds the session associated with the request (if any) and puts it in c.Env["session"].  If
+   the session has expired a new one is created, and c.Env["sessionexpired"] is set to true. See
+   SessionExpiredFromEnv()
+ - saves the session if dirty and the request is processed without a panic.  BuildSessionMiddlewareWithOptions
+   lets you choose a different SavePolicy, and turn on lazy session creation and session fingerprinting
+
+The session is saved and the session cookie sent just before the response headers are
+written, so holders that keep the session in the cookie itself see every change made before
+the handler starts writing its response, and a new session Id from RegenerateId always reaches
+the client. Changes made after that are still saved, but can't update the cookie.
 
 Add the middleware as follows
 
@@ -361,46 +694,220 @@ Add the middleware as follows
   // Add handlers that use sessions
 */
 func BuildSessionMiddleware(sh SessionHolder) func(c *web.C, h http.Handler) http.Handler {
+	return BuildSessionMiddlewareWithOptions(sh, SessionOptions{})
+}
+
+/*
+BuildSessionMiddlewareWithOptions builds session middleware like BuildSessionMiddleware, with
+behaviour controlled by opts
+
+If sh is built on BaseSessionHolder and its cookie options fail CookieOptions.Validate, the error
+is logged, as browsers may reject the session cookie.
+*/
+func BuildSessionMiddlewareWithOptions(sh SessionHolder, opts SessionOptions) func(c *web.C, h http.Handler) http.Handler {
+	if co, ok := sh.(cookieOptioner); ok {
+		if err := co.cookieOptions().Validate(); err != nil {
+			log.Printf("Session cookie options are invalid, so browsers may reject the cookie. %v", err)
+		}
+	}
 	return func(c *web.C, h http.Handler) http.Handler {
 		handler := func(w http.ResponseWriter, r *http.Request) {
 			// Always store the session holder in context so that handlers can create or destroy sessions
 			c.Env["sessionholder"] = sh
+			sw := &sessionResponseWriter{ResponseWriter: w, c: c, sh: sh, policy: opts.SavePolicy, onConflict: opts.OnConflict}
 
-			session, err := sh.Get(*c, r)
-			if err == nil {
-				session.SetDirty(false)
-				c.Env["session"] = session
-			} else {
-				if err == ErrorSessionNotFound {
-					session = sh.Create(*c)
-					// add sessionid to cookie
-					sh.AddToResponse(*c, session, w)
-				} else {
-					log.Printf("error loading session %v", err)
-					http.Error(w, "Failed to load session data", http.StatusServiceUnavailable)
-					return
+			create := func() {
+				// The new session is dirty, so it is saved and the cookie set before the response is written
+				session := sh.Create(*c)
+				if opts.Fingerprint != nil {
+					opts.Fingerprint.record(session, r)
+				}
+				if opts.LazyCreate {
+					// ... unless it's lazy, in which case that only happens if something is Put()
+					session.SetDirty(false)
+					session.whole = true
+					session.lazy = true
+					sw.cookieId = session.Id()
 				}
 			}
-			h.ServeHTTP(w, r)
-
-			// TODO: should this be saved via defer() so it even happens after a panic
-			// TODO: retrieve from response?
-			session, ok := SessionFromEnv(c)
-			if ok {
-				if session.IsDirty() {
-					err := sh.Save(*c, session)
-					if err != nil {
-						log.Printf("Failed to save session - %v", err)
+
+			next := h
+			session, err := sh.Get(*c, r)
+			switch err {
+			case nil:
+				c.Env["session"] = session
+				sw.loaded = true
+				sw.cookieId = session.Id()
+				if opts.Fingerprint != nil && !opts.Fingerprint.matches(session, r) {
+					log.Printf("Session does not match client fingerprint")
+					if mismatch := opts.Fingerprint.OnMismatch; mismatch != nil {
+						next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+							mismatch(c, w, r)
+						})
+						break
 					}
-				} else {
-					/* not dirty but our sessionhandler might need to update the timeout/expiration */
-					err := sh.ResetTTL(*c, session)
-					if err != nil {
-						log.Printf("Failed to update TTL for session - %v", err)
+					if err := sh.Destroy(*c, session); err != nil {
+						log.Printf("Failed to destroy session - %v", err)
 					}
+					sw.loaded = false
+					create()
 				}
+			case ErrorSessionNotFound, ErrorSessionExpired:
+				if err == ErrorSessionExpired {
+					c.Env["sessionexpired"] = true
+					if session != nil {
+						if err := sh.Destroy(*c, session); err != nil {
+							log.Printf("Failed to destroy expired session - %v", err)
+						}
+					}
+				}
+				create()
+			default:
+				log.Printf("error loading session %v", err)
+				http.Error(w, "Failed to load session data", http.StatusServiceUnavailable)
+				return
 			}
+
+			completed := false
+			defer func() {
+				sw.finish(!completed)
+			}()
+			next.ServeHTTP(sw.wrap(), r)
+			completed = true
 		}
 		return http.HandlerFunc(handler)
 	}
 }
+
+// cookieOptioner is implemented by SessionHolders built on BaseSessionHolder
+type cookieOptioner interface {
+	cookieOptions() CookieOptions
+}
+
+// cookieRemover is implemented by SessionHolders built on BaseSessionHolder
+type cookieRemover interface {
+	RemoveFromResponse(c web.C, w http.ResponseWriter)
+}
+
+/*
+sessionResponseWriter saves the session and writes the session cookie just before the response
+headers are written, as after that it is too late to set a cookie.
+*/
+type sessionResponseWriter struct {
+	http.ResponseWriter
+	c          *web.C
+	sh         SessionHolder
+	policy     SavePolicy
+	onConflict ConflictHandler
+	// Have we written a status code and header?
+	headerWritten bool
+	// http status code written
+	status int
+	// Did the request come with a stored session?
+	loaded bool
+	// Has the session been saved during this request?
+	saved bool
+	// The session Id the client has in its cookie, or doesn't yet need to have
+	cookieId string
+}
+
+func (w *sessionResponseWriter) WriteHeader(status int) {
+	if !w.headerWritten {
+		w.headerWritten = true
+		w.status = status
+		w.beforeHeader()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sessionResponseWriter) Write(data []byte) (int, error) {
+	if !w.headerWritten {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// shouldSave applies the SavePolicy
+func (w *sessionResponseWriter) shouldSave(panicked bool) bool {
+	switch w.policy {
+	case SaveAlways:
+		return true
+	case SaveOnSuccess:
+		return !panicked && w.status < http.StatusInternalServerError
+	}
+	return !panicked
+}
+
+// beforeHeader saves a dirty session and adds the cookie to the response if the client needs a new one
+func (w *sessionResponseWriter) beforeHeader() {
+	session, ok := SessionFromEnv(w.c)
+	if !ok {
+		if w.loaded {
+			// The session has been destroyed, so the client should forget it too
+			if cr, ok := w.sh.(cookieRemover); ok {
+				cr.RemoveFromResponse(*w.c, w.ResponseWriter)
+			}
+		}
+		return
+	}
+	if session.IsDirty() {
+		if !w.shouldSave(false) {
+			return
+		}
+		if err := w.save(session); err != nil {
+			log.Printf("Failed to save session - %v", err)
+			return
+		}
+		session.SetDirty(false)
+		w.saved = true
+	} else if session.Id() == w.cookieId {
+		return
+	}
+	// The session is new, has changed or has a new Id
+	w.sh.AddToResponse(*w.c, session, w.ResponseWriter)
+	w.cookieId = session.Id()
+}
+
+// finish is called after the handler completes, or panics
+func (w *sessionResponseWriter) finish(panicked bool) {
+	if !w.headerWritten {
+		// The handler didn't write anything. The headers aren't written until we return, so there's
+		// still time to set the cookie.  If the handler panicked, whatever catches the panic writes
+		// the response
+		w.headerWritten = true
+		w.status = http.StatusOK
+		if panicked {
+			w.status = http.StatusInternalServerError
+		}
+		if w.shouldSave(panicked) {
+			w.beforeHeader()
+		}
+	}
+
+	session, ok := SessionFromEnv(w.c)
+	if !ok || !w.shouldSave(panicked) {
+		return
+	}
+	if session.IsDirty() {
+		if !w.loaded && !w.saved {
+			// A lazy session written to too late. The client will never send us its Id, so don't save it
+			log.Printf("New session %s changed after response headers were written. Not saved", session.Id())
+			return
+		}
+		// Changed after the headers were written
+		err := w.save(session)
+		if err != nil {
+			log.Printf("Failed to save session - %v", err)
+		}
+		session.SetDirty(false)
+	} else if w.loaded && !w.saved {
+		/* not dirty but our sessionhandler might need to update the timeout/expiration */
+		err := w.sh.ResetTTL(*w.c, session)
+		if err != nil {
+			log.Printf("Failed to update TTL for session - %v", err)
+		}
+	}
+	if (w.loaded || w.saved) && session.Id() != w.cookieId {
+		log.Printf("Session Id changed after response headers were written. Client has the old Id")
+	}
+}
@@ -1,10 +1,15 @@
 package base
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/zenazn/goji/web"
 )
@@ -94,7 +99,7 @@ func TestBaseSessionHolderAddToResponse(t *testing.T) {
 	sh.AddToResponse(c, s, w)
 
 	cookie := w.HeaderMap.Get("Set-Cookie")
-	if cookie != fmt.Sprintf("sessionid=%s; Path=/; Max-Age=%d", s.Id(), sh.GetTimeout()) {
+	if cookie != fmt.Sprintf("sessionid=%s; Path=/; Max-Age=%d", s.Id(), sh.GetTimeout()+DEFAULT_EXPIRY_GRACE) {
 		t.Fatalf("Persistent Cookie not as expected - have %s", cookie)
 	}
 
@@ -146,7 +151,8 @@ func TestSessionMiddleware(t *testing.T) {
 	// Serve the request
 	m(&c, h).ServeHTTP(w, r)
 
-	if c.Env["session"].(*Session) != s {
+	// The holder returns its own copy of the session
+	if c.Env["session"].(*Session).Id() != s.Id() {
 		t.Fatalf("session not added to c.Env")
 	}
 
@@ -172,8 +178,443 @@ func TestSessionMiddleware(t *testing.T) {
 	// Serve the request
 	m(&c, h).ServeHTTP(w, r)
 
-	if c.Env["session"].(*Session) != s {
+	if c.Env["session"].(*Session).Id() != s.Id() {
 		t.Fatalf("session update not added to c.Env")
 	}
 
 }
+
+func TestCookieOptions(t *testing.T) {
+	c := makeEnv()
+
+	tests := []struct {
+		opts   CookieOptions
+		err    error
+		cookie string
+	}{
+		{
+			opts:   CookieOptions{Name: "sid", Domain: "example.com", Path: "/app"},
+			cookie: "sid=%s; Path=/app; Domain=example.com; Max-Age=%d",
+		},
+		{
+			opts:   CookieOptions{Name: "sid", Prefix: HostPrefix},
+			cookie: "__Host-sid=%s; Path=/; Max-Age=%d; Secure",
+		},
+		{
+			opts:   CookieOptions{Prefix: SecurePrefix, Path: "/app"},
+			cookie: "__Secure-sessionid=%s; Path=/app; Max-Age=%d; Secure",
+		},
+		{
+			opts: CookieOptions{Prefix: HostPrefix, Path: "/app"},
+			err:  ErrorHostPrefix,
+		},
+		{
+			opts: CookieOptions{Prefix: HostPrefix, Domain: "example.com"},
+			err:  ErrorHostPrefix,
+		},
+		{
+			opts: CookieOptions{Name: "__Host-sid"},
+			err:  ErrorCookiePrefix,
+		},
+	}
+
+	for _, test := range tests {
+		sh := NewMemorySessionHolder(30)
+		err := sh.(CookieOptionsSetter).SetCookieOptions(test.opts)
+		if err != test.err {
+			t.Errorf("expected error %v for %v, got %v", test.err, test.opts, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		s := sh.Create(c)
+		sh.Save(c, s)
+		w := httptest.NewRecorder()
+		sh.AddToResponse(c, s, w)
+		cookie := w.HeaderMap.Get("Set-Cookie")
+		if cookie != fmt.Sprintf(test.cookie, s.Id(), 30+DEFAULT_EXPIRY_GRACE) {
+			t.Errorf("cookie not as expected for %v - have %s", test.opts, cookie)
+		}
+
+		// Check we can find the session from the cookie
+		r := requestWithCookies(w)
+		s1, err := sh.Get(c, r)
+		if err != nil || s1.Id() != s.Id() {
+			t.Errorf("could not read session from cookie for %v. %v", test.opts, err)
+		}
+	}
+}
+
+func TestSessionMiddlewareCookieOptions(t *testing.T) {
+	// Invalid options set directly in the Cookie field don't stop the middleware being built,
+	// and a __Host- cookie is still sent in a form browsers accept
+	sh := NewMemorySessionHolder(30).(*MemorySessionHolder)
+	sh.Cookie = CookieOptions{Name: "sessionid", Path: "/cheese", Domain: "example.com", Prefix: HostPrefix}
+	m := BuildSessionMiddleware(sh)
+
+	c := makeEnv()
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	r, _ := http.NewRequest("GET", "/cheese", nil)
+	w := httptest.NewRecorder()
+	m(&c, h).ServeHTTP(w, r)
+
+	s, _ := SessionFromEnv(&c)
+	cookie := w.HeaderMap.Get("Set-Cookie")
+	if cookie != fmt.Sprintf("__Host-sessionid=%s; Path=/; Max-Age=%d; Secure", s.Id(), 30+DEFAULT_EXPIRY_GRACE) {
+		t.Fatalf("cookie not as expected - have %s", cookie)
+	}
+}
+
+func TestSessionMiddlewareLazyCreate(t *testing.T) {
+	sh := NewMemorySessionHolder(30).(*MemorySessionHolder)
+	m := BuildSessionMiddlewareWithOptions(sh, SessionOptions{LazyCreate: true})
+
+	// A request that doesn't write to the session gets no cookie and nothing is stored
+	c := makeEnv()
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := SessionFromEnv(&c); !ok {
+			t.Errorf("lazy session not available in c.Env")
+		}
+		w.WriteHeader(200)
+	})
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	m(&c, h).ServeHTTP(w, r)
+
+	if cookie := w.HeaderMap.Get("Set-Cookie"); cookie != "" {
+		t.Fatalf("expected no cookie for unused lazy session, have %s", cookie)
+	}
+	if sh.Len() != 0 {
+		t.Fatalf("expected no session to be stored, have %d", sh.Len())
+	}
+
+	// Writing to the session saves it and sets the cookie
+	c = makeEnv()
+	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, _ := SessionFromEnv(&c)
+		s.Put("cheese", "gouda")
+		w.WriteHeader(200)
+	})
+	w = httptest.NewRecorder()
+	m(&c, h).ServeHTTP(w, r)
+
+	s, err := sh.Get(c, requestWithCookies(w))
+	if err != nil {
+		t.Fatalf("lazy session not saved once written - %v", err)
+	}
+	if cheese, _ := s.Get("cheese"); cheese != "gouda" {
+		t.Fatalf("not the cheese we were hoping for. %v", cheese)
+	}
+}
+
+func TestSessionMiddlewareRegenerateId(t *testing.T) {
+	c := makeEnv()
+	sh := NewMemorySessionHolder(30)
+	m := BuildSessionMiddleware(sh)
+
+	s := sh.Create(c)
+	sh.Save(c, s)
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Cookie", fmt.Sprintf("sessionid=%s", s.Id()))
+
+	var newId string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, _ := SessionFromEnv(&c)
+		newId, _ = sh.RegenerateId(c, s)
+		w.Write([]byte("logged in"))
+	})
+	w := httptest.NewRecorder()
+	m(&c, h).ServeHTTP(w, r)
+
+	cookie := w.HeaderMap.Get("Set-Cookie")
+	if cookie != fmt.Sprintf("sessionid=%s; Path=/; Max-Age=%d", newId, 30+DEFAULT_EXPIRY_GRACE) {
+		t.Fatalf("cookie not updated with regenerated id - have %s", cookie)
+	}
+}
+
+func TestSessionMiddlewareSavePolicy(t *testing.T) {
+	tests := []struct {
+		policy   SavePolicy
+		status   int
+		panics   bool
+		expSaved bool
+	}{
+		{policy: SaveUnlessPanic, status: 200, expSaved: true},
+		{policy: SaveUnlessPanic, status: 500, expSaved: true},
+		{policy: SaveUnlessPanic, panics: true, expSaved: false},
+		{policy: SaveAlways, status: 500, expSaved: true},
+		{policy: SaveAlways, panics: true, expSaved: true},
+		{policy: SaveOnSuccess, status: 200, expSaved: true},
+		{policy: SaveOnSuccess, status: 503, expSaved: false},
+		{policy: SaveOnSuccess, panics: true, expSaved: false},
+	}
+
+	for _, test := range tests {
+		c := makeEnv()
+		sh := NewMemorySessionHolder(30)
+		m := BuildSessionMiddlewareWithOptions(sh, SessionOptions{SavePolicy: test.policy})
+
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s, _ := SessionFromEnv(&c)
+			s.Put("cheese", "wensleydale")
+			if test.panics {
+				panic("oops")
+			}
+			w.WriteHeader(test.status)
+		})
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/", nil)
+		func() {
+			defer func() {
+				recover()
+			}()
+			m(&c, h).ServeHTTP(w, r)
+		}()
+
+		_, err := sh.Get(c, requestWithCookies(w))
+		if saved := err == nil; saved != test.expSaved {
+			t.Errorf("policy %d, status %d, panic %t: expected saved %t", test.policy, test.status, test.panics, test.expSaved)
+		}
+	}
+}
+
+func TestSessionMiddlewareSaveAfterWrite(t *testing.T) {
+	c := makeEnv()
+	sh := NewMemorySessionHolder(30)
+	m := BuildSessionMiddleware(sh)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, _ := SessionFromEnv(&c)
+		s.Put("cheese", "cheddar")
+		w.Write([]byte("hello"))
+		s.Put("hat", "fedora")
+	})
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	m(&c, h).ServeHTTP(w, r)
+
+	s, err := sh.Get(c, requestWithCookies(w))
+	if err != nil {
+		t.Fatalf("session not saved - %v", err)
+	}
+	if hat, _ := s.Get("hat"); hat != "fedora" {
+		t.Fatalf("value put after the response was written not saved")
+	}
+}
+
+func TestSessionMiddlewareFlush(t *testing.T) {
+	c := makeEnv()
+	sh := NewMemorySessionHolder(30)
+	m := BuildSessionMiddleware(sh)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, _ := SessionFromEnv(&c)
+		s.Put("cheese", "cheddar")
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatalf("ResponseWriter is not a Flusher")
+		}
+		f.Flush()
+		if _, ok := w.(http.Hijacker); ok {
+			t.Fatalf("ResponseWriter should not be a Hijacker")
+		}
+	})
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	m(&c, h).ServeHTTP(w, r)
+
+	if !w.Flushed {
+		t.Fatalf("response not flushed")
+	}
+	s, err := sh.Get(c, requestWithCookies(w))
+	if err != nil {
+		t.Fatalf("session not saved before flush - %v", err)
+	}
+	if cheese, _ := s.Get("cheese"); cheese != "cheddar" {
+		t.Fatalf("cheese is %v", cheese)
+	}
+}
+
+// hijackRecorder is a ResponseRecorder that implements all the optional ResponseWriter interfaces
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) CloseNotify() <-chan bool { return make(chan bool) }
+
+func (w *hijackRecorder) ReadFrom(r io.Reader) (int64, error) { return io.Copy(w.ResponseRecorder, r) }
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestSessionMiddlewareHijack(t *testing.T) {
+	c := makeEnv()
+	sh := NewMemorySessionHolder(30)
+	m := BuildSessionMiddleware(sh)
+
+	var sessionId string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, _ := SessionFromEnv(&c)
+		sessionId = s.Id()
+		s.Put("cheese", "brie")
+		for _, ok := range []bool{
+			implements(w, (*http.Flusher)(nil)),
+			implements(w, (*http.CloseNotifier)(nil)),
+			implements(w, (*io.ReaderFrom)(nil)),
+		} {
+			if !ok {
+				t.Fatalf("ResponseWriter is missing an interface")
+			}
+		}
+		w.(http.Hijacker).Hijack()
+		if sh.(*MemorySessionHolder).Len() != 1 {
+			t.Fatalf("session not saved before hijack")
+		}
+	})
+	w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	r, _ := http.NewRequest("GET", "/", nil)
+	m(&c, h).ServeHTTP(w, r)
+
+	if !w.hijacked {
+		t.Fatalf("connection not hijacked")
+	}
+	if sessionId == "" {
+		t.Fatalf("no session")
+	}
+}
+
+func implements(w http.ResponseWriter, iface interface{}) bool {
+	return reflect.TypeOf(w).Implements(reflect.TypeOf(iface).Elem())
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	c := makeEnv()
+	sh := NewBaseSessionHolder(60)
+	sh.SetMaxLifetime(3600)
+	sh.ExpiryGrace = 10
+
+	s := sh.Create(c)
+	now := s.Created
+
+	if ttl := sh.SessionTTL(s, now); ttl != 60 {
+		t.Errorf("expected idle timeout to limit TTL, have %d", ttl)
+	}
+	if ttl := sh.StoreTTL(s, now); ttl != 70 {
+		t.Errorf("expected store TTL to include grace, have %d", ttl)
+	}
+	if ttl := sh.SessionTTL(s, now.Add(3590*time.Second)); ttl != 10 {
+		t.Errorf("expected maximum lifetime to limit TTL, have %d", ttl)
+	}
+
+	tests := []struct {
+		accessed time.Duration
+		now      time.Duration
+		err      error
+	}{
+		{accessed: 0, now: 59 * time.Second, err: nil},
+		{accessed: 0, now: 61 * time.Second, err: ErrorSessionExpired},
+		{accessed: 3000 * time.Second, now: 3059 * time.Second, err: nil},
+		{accessed: 3580 * time.Second, now: 3601 * time.Second, err: ErrorSessionExpired},
+	}
+	for _, test := range tests {
+		s.LastAccess = s.Created.Add(test.accessed)
+		if err := sh.CheckExpiry(s, s.Created.Add(test.now)); err != test.err {
+			t.Errorf("accessed %s, now %s: expected %v, have %v", test.accessed, test.now, test.err, err)
+		}
+	}
+
+	// Sessions stored before creation times were recorded get a lifetime from when they are
+	// loaded, and are marked to be saved with it
+	legacy := &Session{Values: map[string]interface{}{}, LastAccess: now}
+	if err := sh.CheckExpiry(legacy, now.Add(30*time.Second)); err != nil {
+		t.Errorf("legacy session should not have expired, have %v", err)
+	}
+	if !legacy.Created.Equal(now.Add(30*time.Second)) || !legacy.IsDirty() {
+		t.Errorf("legacy session not given a creation time, have %v, dirty %t", legacy.Created, legacy.IsDirty())
+	}
+	if ttl := sh.SessionTTL(legacy, now.Add(3620*time.Second)); ttl != 10 {
+		t.Errorf("expected maximum lifetime to limit legacy session TTL, have %d", ttl)
+	}
+
+	// No timeouts means no expiry
+	sh = NewBaseSessionHolder(0)
+	if ttl := sh.StoreTTL(s, now); ttl != 0 {
+		t.Errorf("expected no TTL, have %d", ttl)
+	}
+	if err := sh.CheckExpiry(s, now.Add(1000*time.Hour)); err != nil {
+		t.Errorf("session with no timeouts expired")
+	}
+}
+
+func TestSessionMiddlewareExpired(t *testing.T) {
+	c := makeEnv()
+	sh := NewLimitedMemorySessionHolder(30, 0)
+	defer sh.Close()
+	sh.SetMaxLifetime(60)
+	m := BuildSessionMiddleware(sh)
+
+	s := sh.Create(c)
+	s.Created = s.Created.Add(-time.Hour)
+	sh.Save(c, s)
+
+	var expired bool
+	var newSession *Session
+	c = makeEnv()
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expired = SessionExpiredFromEnv(&c)
+		newSession, _ = SessionFromEnv(&c)
+	})
+	w := httptest.NewRecorder()
+	m(&c, h).ServeHTTP(w, requestForSession(s))
+
+	if !expired {
+		t.Fatalf("expected session to be reported as expired")
+	}
+	if newSession == nil || newSession.Id() == s.Id() {
+		t.Fatalf("expected a new session to replace the expired one")
+	}
+	if sh.Len() != 1 {
+		t.Fatalf("expected expired session to be destroyed, have %d sessions", sh.Len())
+	}
+}
+
+func TestSessionChanges(t *testing.T) {
+	c := makeEnv()
+	sh := NewMemorySessionHolder(30)
+
+	s := sh.Create(c)
+	s.Put("cheese", "stilton")
+	if _, partial := s.Changes(); partial {
+		t.Fatalf("new sessions should be saved whole")
+	}
+	sh.Save(c, s)
+	s.SetDirty(false)
+
+	s.Put("cheese", "brie")
+	s.Put("hat", "bowler")
+	s.Del("hat")
+	s.Del("coat")
+	changes, partial := s.Changes()
+	if !partial || !reflect.DeepEqual(changes, map[string]bool{"cheese": true, "hat": false, "coat": false}) {
+		t.Fatalf("changes not the cheese we were hoping for, %v %v", changes, partial)
+	}
+
+	s.SetDirty(false)
+	if changes, partial := s.Changes(); !partial || len(changes) != 0 {
+		t.Fatalf("changes should be forgotten, %v %v", changes, partial)
+	}
+
+	s.SetDirty(true)
+	s.Put("cheese", "edam")
+	if _, partial := s.Changes(); partial {
+		t.Fatalf("session marked dirty should be saved whole")
+	}
+}
@@ -0,0 +1,88 @@
+package base
+
+import (
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+)
+
+const (
+	// Default number of random bytes in a session id
+	DEFAULT_SESSION_ID_BYTES = 32
+)
+
+// Used by BaseSessionHolders that don't have an IdGenerator set
+var defaultIdGenerator = NewRandomIdGenerator(DEFAULT_SESSION_ID_BYTES, Base64URLEncoding)
+
+// IdEncoding selects how the random bytes of a session id are turned into a string
+type IdEncoding int
+
+const (
+	// Base64URLEncoding is unpadded URL-safe base64.  It is the default
+	Base64URLEncoding IdEncoding = iota
+	// HexEncoding is lower-case hex
+	HexEncoding
+)
+
+/*
+IDGenerator generates session ids, and checks ids presented by clients look like ones it could
+have generated.
+*/
+type IDGenerator interface {
+	// GenerateId returns a new, unguessable session id
+	GenerateId() string
+	// ValidId returns true if id has the format of ids from GenerateId
+	ValidId(id string) bool
+}
+
+/*
+RandomIdGenerator is an IDGenerator that builds ids from crypto/rand.  It is safe for concurrent use.
+*/
+type RandomIdGenerator struct {
+	// Number of random bytes in each id
+	Bytes int
+	// How the bytes are encoded
+	Encoding IdEncoding
+}
+
+/*
+NewRandomIdGenerator creates an IDGenerator making ids from bytes random bytes, encoded with encoding.
+
+Bear in mind the length of the encoded id if your session store limits it.  For example the postgres
+session store allows up to 72 characters.
+*/
+func NewRandomIdGenerator(bytes int, encoding IdEncoding) *RandomIdGenerator {
+	return &RandomIdGenerator{
+		Bytes:    bytes,
+		Encoding: encoding,
+	}
+}
+
+func (g *RandomIdGenerator) GenerateId() string {
+	b := make([]byte, g.Bytes)
+	if _, err := crand.Read(b); err != nil {
+		log.Panicf("Could not get random bytes for session id, %v", err)
+	}
+	if g.Encoding == HexEncoding {
+		return hex.EncodeToString(b)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (g *RandomIdGenerator) ValidId(id string) bool {
+	var b []byte
+	var err error
+	if g.Encoding == HexEncoding {
+		if len(id) != hex.EncodedLen(g.Bytes) {
+			return false
+		}
+		b, err = hex.DecodeString(id)
+	} else {
+		if len(id) != base64.RawURLEncoding.EncodedLen(g.Bytes) {
+			return false
+		}
+		b, err = base64.RawURLEncoding.DecodeString(id)
+	}
+	return err == nil && len(b) == g.Bytes
+}
@@ -0,0 +1,65 @@
+package base
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRandomIdGenerator(t *testing.T) {
+	tests := []struct {
+		bytes    int
+		encoding IdEncoding
+		length   int
+		invalid  []string
+	}{
+		{
+			bytes: 32, encoding: Base64URLEncoding, length: 43,
+			invalid: []string{"", "abc", "0123456789abcdef0123456789abcdef0123456789+", "0123456789abcdef0123456789abcdef0123456789abc"},
+		},
+		{
+			bytes: 16, encoding: HexEncoding, length: 32,
+			invalid: []string{"", "abc", "0123456789abcdef0123456789abcdeg", "0123456789abcdef0123456789abcdef0"},
+		},
+	}
+
+	for _, test := range tests {
+		g := NewRandomIdGenerator(test.bytes, test.encoding)
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			id := g.GenerateId()
+			if len(id) != test.length {
+				t.Errorf("expected id of length %d, have %q", test.length, id)
+			}
+			if !g.ValidId(id) {
+				t.Errorf("generated id %q is not valid", id)
+			}
+			if seen[id] {
+				t.Errorf("id %q generated twice", id)
+			}
+			seen[id] = true
+		}
+
+		for _, id := range test.invalid {
+			if g.ValidId(id) {
+				t.Errorf("id %q should not be valid", id)
+			}
+		}
+	}
+}
+
+func TestGetSessionIdRejectsInvalid(t *testing.T) {
+	sh := NewBaseSessionHolder(30)
+	sh.SetIdGenerator(NewRandomIdGenerator(8, HexEncoding))
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sessionid", Value: "not-a-session-id"})
+	if id := sh.GetSessionId(r); id != "" {
+		t.Fatalf("expected invalid session id to be ignored, got %q", id)
+	}
+
+	r, _ = http.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sessionid", Value: "0123456789abcdef"})
+	if id := sh.GetSessionId(r); id != "0123456789abcdef" {
+		t.Fatalf("expected valid session id, got %q", id)
+	}
+}
@@ -0,0 +1,76 @@
+package base
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+/*
+wrap returns w as the ResponseWriter to pass to handlers.  Handlers can use the same optional
+interfaces as on the ResponseWriter the middleware was given: http.Flusher, http.Hijacker,
+http.CloseNotifier and io.ReaderFrom.  As with goji's mutil.WrapWriter, only the combinations the
+standard library's ResponseWriters implement are supported.
+*/
+func (w *sessionResponseWriter) wrap() http.ResponseWriter {
+	_, cn := w.ResponseWriter.(http.CloseNotifier)
+	_, fl := w.ResponseWriter.(http.Flusher)
+	_, hj := w.ResponseWriter.(http.Hijacker)
+	_, rf := w.ResponseWriter.(io.ReaderFrom)
+	if cn && fl && hj && rf {
+		return &fancySessionWriter{w}
+	}
+	if fl {
+		return &flushSessionWriter{w}
+	}
+	return w
+}
+
+// flushSessionWriter is a sessionResponseWriter that implements http.Flusher
+type flushSessionWriter struct {
+	*sessionResponseWriter
+}
+
+// Flush saves the session and sets the cookie if the headers haven't been written yet, then flushes
+func (w *flushSessionWriter) Flush() {
+	if !w.headerWritten {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// fancySessionWriter is a sessionResponseWriter that implements all the optional interfaces
+type fancySessionWriter struct {
+	*sessionResponseWriter
+}
+
+func (w *fancySessionWriter) Flush() {
+	if !w.headerWritten {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// CloseNotify doesn't write anything, so leaves the session to be saved when the response is
+func (w *fancySessionWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+// Hijack saves the session before handing over the connection.  The handler writes its own
+// response headers, so sets the session cookie itself if it needs to
+func (w *fancySessionWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if !w.headerWritten {
+		w.headerWritten = true
+		w.status = http.StatusSwitchingProtocols
+		w.beforeHeader()
+	}
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (w *fancySessionWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.headerWritten {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+}
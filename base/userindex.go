@@ -0,0 +1,60 @@
+package base
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+/*
+SessionInfo describes one of a user's sessions
+*/
+type SessionInfo struct {
+	Id         string
+	Created    time.Time
+	LastAccess time.Time
+	UserAgent  string
+}
+
+/*
+UserSessionIndex is an optional capability of a SessionHolder that keeps track of which sessions
+belong to each user.  This lets you revoke all a user's sessions when they change their password or
+their account is disabled.
+
+Check whether a holder supports it with a type assertion
+
+	if index, ok := sh.(base.UserSessionIndex); ok {
+		err = index.DestroyUserSessions(c, userId)
+	}
+*/
+type UserSessionIndex interface {
+	/*
+	   BindUser records that session belongs to userId, along with the User-Agent from r, and saves
+	   the session.  Call this when the user logs in, after RegenerateId
+	*/
+	BindUser(c web.C, r *http.Request, session *Session, userId string) error
+
+	/*
+	   UserSessions lists the user's sessions that have not expired, most recently used first
+	*/
+	UserSessions(c web.C, userId string) ([]SessionInfo, error)
+
+	/*
+	   DestroyUserSessions destroys all the user's sessions.  If the current session belongs to the
+	   user it is removed from c.Env["session"] too
+	*/
+	DestroyUserSessions(c web.C, userId string) error
+}
+
+/*
+Info returns a SessionInfo describing the session
+*/
+func (s *Session) Info() SessionInfo {
+	return SessionInfo{
+		Id:         s.Id(),
+		Created:    s.Created,
+		LastAccess: s.LastAccess,
+		UserAgent:  s.UserAgent,
+	}
+}
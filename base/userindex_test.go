@@ -0,0 +1,64 @@
+package base
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMemoryUserSessions(t *testing.T) {
+	c := makeEnv()
+	sh := NewLimitedMemorySessionHolder(30, 0)
+	defer sh.Close()
+	var index UserSessionIndex = sh
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "cheese-browser/1.0")
+
+	s1 := sh.Create(c)
+	if err := index.BindUser(c, r, s1, "wallace"); err != nil {
+		t.Fatalf("failed to bind user - %v", err)
+	}
+	s2 := sh.Create(c)
+	if err := index.BindUser(c, r, s2, "wallace"); err != nil {
+		t.Fatalf("failed to bind user - %v", err)
+	}
+	other := sh.Create(c)
+	if err := index.BindUser(c, r, other, "gromit"); err != nil {
+		t.Fatalf("failed to bind user - %v", err)
+	}
+
+	infos, err := index.UserSessions(c, "wallace")
+	if err != nil {
+		t.Fatalf("failed to list sessions - %v", err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 sessions, have %v", infos)
+	}
+	if infos[0].Id != s2.Id() || infos[1].Id != s1.Id() {
+		t.Fatalf("sessions not most recent first, %v", infos)
+	}
+	if infos[0].UserAgent != "cheese-browser/1.0" || infos[0].Created.IsZero() {
+		t.Fatalf("session info not the cheese we were hoping for, %v", infos[0])
+	}
+
+	// The current session (other) belongs to someone else, so stays in the env
+	if err := index.DestroyUserSessions(c, "wallace"); err != nil {
+		t.Fatalf("failed to destroy sessions - %v", err)
+	}
+	if _, err := sh.Get(c, requestForSession(s1)); err != ErrorSessionNotFound {
+		t.Fatalf("session should be destroyed, have %v", err)
+	}
+	if _, err := sh.Get(c, requestForSession(other)); err != nil {
+		t.Fatalf("other user's session should survive, have %v", err)
+	}
+	if _, ok := SessionFromEnv(&c); !ok {
+		t.Fatalf("current session should not be removed from env")
+	}
+
+	if err := index.DestroyUserSessions(c, "gromit"); err != nil {
+		t.Fatalf("failed to destroy sessions - %v", err)
+	}
+	if _, ok := SessionFromEnv(&c); ok {
+		t.Fatalf("current session should be removed from env")
+	}
+}
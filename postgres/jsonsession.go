@@ -0,0 +1,294 @@
+package postgres
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/philpearl/tt_goji_middleware/base"
+
+	"github.com/lib/pq"
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	DEFAULT_SCHEMA     = "public"
+	DEFAULT_JSON_TABLE = "json_sessions"
+)
+
+/*
+JSONSessionOptions controls where JSONSessionHolder keeps its sessions
+*/
+type JSONSessionOptions struct {
+	// Schema for the sessions table.  Defaults to DEFAULT_SCHEMA.  It is created if it doesn't exist
+	Schema string
+	// Name of the sessions table.  Defaults to DEFAULT_JSON_TABLE.  It is created if it doesn't exist
+	Table string
+}
+
+/*
+JSONSessionHolder is a Postgres-backed session store that keeps session values in a jsonb column,
+so they can be queried in SQL.  Values are encoded with encoding/json, so they come back as the
+types encoding/json decodes into an interface{}.  For example numbers are always float64.
+
+It needs Postgres 9.5 or later.  Saves are a single INSERT ... ON CONFLICT statement, and all
+statements are prepared when the holder is created.  Call Close() to release them.
+
+Like SessionHolder, it reports ErrorSessionExpired for sessions that expired within the last
+ExpiryGrace seconds, ignores older ones, can have a Reaper delete them, and implements
+base.UserSessionIndex.
+*/
+type JSONSessionHolder struct {
+	base.BaseSessionHolder
+	db    *sql.DB
+	table string
+
+	get                 *sql.Stmt
+	upsert              *sql.Stmt
+	update              *sql.Stmt
+	exists              *sql.Stmt
+	destroy             *sql.Stmt
+	regenerateId        *sql.Stmt
+	resetTTL            *sql.Stmt
+	userSessions        *sql.Stmt
+	destroyUserSessions *sql.Stmt
+}
+
+/*
+NewJSONSessionHolder creates a postgres-backed session holder that stores sessions as jsonb in
+the table named in opts, creating the table if necessary.  Its migrations are recorded under the
+component "json_sessions:" followed by the quoted schema and table name
+*/
+func NewJSONSessionHolder(db *sql.DB, opts JSONSessionOptions) (*JSONSessionHolder, error) {
+	if opts.Schema == "" {
+		opts.Schema = DEFAULT_SCHEMA
+	}
+	if opts.Table == "" {
+		opts.Table = DEFAULT_JSON_TABLE
+	}
+
+	sh := &JSONSessionHolder{
+		BaseSessionHolder: base.NewBaseSessionHolder(DEFAULT_SESSION_TIMEOUT),
+		db:                db,
+		table:             pq.QuoteIdentifier(opts.Schema) + "." + pq.QuoteIdentifier(opts.Table),
+	}
+
+	if err := RunMigrations(db, "json_sessions:"+sh.table, jsonSessionMigrations(opts)); err != nil {
+		return nil, err
+	}
+
+	statements := []struct {
+		stmt **sql.Stmt
+		sql  string
+	}{
+		{&sh.get, `SELECT content, created_at, accessed_at, coalesce(expires < now(), false), coalesce(user_id, ''), coalesce(user_agent, ''), version
+			FROM %s WHERE id=$1 AND (expires IS NULL OR expires >= now() - $2 * interval '1 second')`},
+		{&sh.upsert, `INSERT INTO %s AS s (id, content, expires, created_at, accessed_at, user_id, user_agent, version)
+			VALUES ($1, $2, now() + $3 * interval '1 second', $4, now(), $5, $6, $7::bigint + 1)
+			ON CONFLICT (id) DO UPDATE SET content=EXCLUDED.content, expires=EXCLUDED.expires,
+				accessed_at=EXCLUDED.accessed_at, user_id=EXCLUDED.user_id, user_agent=EXCLUDED.user_agent, version=EXCLUDED.version
+			WHERE s.version=$7`},
+		{&sh.update, `UPDATE %s SET content=$2, expires=now() + $3 * interval '1 second', accessed_at=now(),
+			user_id=$4, user_agent=$5, version=$6::bigint + 1
+			WHERE id=$1 AND version=$6`},
+		{&sh.exists, `SELECT EXISTS (SELECT 1 FROM %s WHERE id=$1)`},
+		{&sh.destroy, `DELETE FROM %s WHERE id=$1`},
+		{&sh.regenerateId, `UPDATE %s SET id=$2 WHERE id=$1`},
+		{&sh.resetTTL, `UPDATE %s SET expires=now() + $2 * interval '1 second', accessed_at=now() WHERE id=$1`},
+		{&sh.userSessions, `SELECT id, created_at, accessed_at, coalesce(user_agent, '') FROM %s
+			WHERE user_id=$1 AND (expires IS NULL OR expires >= now())
+			ORDER BY accessed_at DESC`},
+		{&sh.destroyUserSessions, `DELETE FROM %s WHERE user_id=$1`},
+	}
+	for _, s := range statements {
+		stmt, err := db.Prepare(fmt.Sprintf(s.sql, sh.table))
+		if err != nil {
+			sh.Close()
+			return nil, err
+		}
+		*s.stmt = stmt
+	}
+
+	return sh, nil
+}
+
+// jsonSessionMigrations builds the table for JSONSessionHolder
+func jsonSessionMigrations(opts JSONSessionOptions) []Migration {
+	table := pq.QuoteIdentifier(opts.Schema) + "." + pq.QuoteIdentifier(opts.Table)
+	var create []string
+	if opts.Schema != DEFAULT_SCHEMA {
+		create = append(create, "CREATE SCHEMA IF NOT EXISTS "+pq.QuoteIdentifier(opts.Schema))
+	}
+	create = append(create,
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			id text PRIMARY KEY,
+			content jsonb NOT NULL,
+			expires timestamp with time zone,
+			created_at timestamp with time zone,
+			accessed_at timestamp with time zone,
+			user_id text,
+			user_agent text
+		)`, table),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (user_id)", pq.QuoteIdentifier(opts.Table+"_user_id"), table),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (expires)", pq.QuoteIdentifier(opts.Table+"_expires"), table),
+	)
+	return []Migration{
+		{1, create},
+		{2, []string{fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 0", table)}},
+	}
+}
+
+/*
+Close releases the prepared statements
+*/
+func (sh *JSONSessionHolder) Close() error {
+	for _, stmt := range []*sql.Stmt{
+		sh.get, sh.upsert, sh.update, sh.exists, sh.destroy, sh.regenerateId, sh.resetTTL, sh.userSessions, sh.destroyUserSessions,
+	} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return nil
+}
+
+/*
+Get the session for this request from Postgres
+*/
+func (sh *JSONSessionHolder) Get(c web.C, r *http.Request) (*base.Session, error) {
+	sessionId := sh.GetSessionId(r)
+	if sessionId == "" {
+		return nil, base.ErrorSessionNotFound
+	}
+
+	var session base.Session
+	var content []byte
+	var created, accessed pq.NullTime
+	var expired bool
+
+	err := sh.get.QueryRow(sessionId, sh.ExpiryGrace).Scan(&content, &created, &accessed, &expired, &session.UserId, &session.UserAgent, &session.Version)
+	if err == sql.ErrNoRows {
+		return nil, base.ErrorSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &session.Values); err != nil {
+		return nil, err
+	}
+	if session.Values == nil {
+		session.Values = make(map[string]interface{})
+	}
+	session.SetId(sessionId)
+	session.Created = created.Time
+	session.LastAccess = accessed.Time
+	if expired {
+		return &session, base.ErrorSessionExpired
+	}
+	return &session, nil
+}
+
+/*
+Destroy deletes a session from postgres
+*/
+func (sh *JSONSessionHolder) Destroy(c web.C, session *base.Session) error {
+	delete(c.Env, "session")
+	_, err := sh.destroy.Exec(session.Id())
+	return err
+}
+
+/*
+Save a session to postgres.  Returns base.ErrorSessionConflict if the stored session has been
+saved since this one was loaded
+*/
+func (sh *JSONSessionHolder) Save(c web.C, session *base.Session) error {
+	content, err := json.Marshal(session.Values)
+	if err != nil {
+		return err
+	}
+	ttl := sessionTTL(&sh.BaseSessionHolder, session)
+
+	// Sessions that have been saved before are only updated, so a destroyed session isn't
+	// brought back
+	var res sql.Result
+	if session.Version > 0 {
+		res, err = sh.update.Exec(
+			session.Id(), string(content), ttl, nullString(session.UserId), session.UserAgent, session.Version,
+		)
+	} else {
+		res, err = sh.upsert.Exec(
+			session.Id(), string(content), ttl, session.Created,
+			nullString(session.UserId), session.UserAgent, session.Version,
+		)
+	}
+	if err != nil {
+		return err
+	}
+	// Nothing is inserted or updated when the stored session has a different version or is gone
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sh.missingSession(session.Id())
+	}
+	session.Version++
+	return nil
+}
+
+// missingSession says why a session couldn't be saved
+func (sh *JSONSessionHolder) missingSession(sessionId string) error {
+	var exists bool
+	if err := sh.exists.QueryRow(sessionId).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return base.ErrorSessionConflict
+	}
+	return base.ErrorSessionNotFound
+}
+
+func (sh *JSONSessionHolder) RegenerateId(c web.C, session *base.Session) (string, error) {
+	newSessionId := sh.GenerateSessionId()
+	if _, err := sh.regenerateId.Exec(session.Id(), newSessionId); err != nil {
+		return session.Id(), err
+	}
+	session.SetId(newSessionId)
+	return newSessionId, nil
+}
+
+func (sh *JSONSessionHolder) ResetTTL(c web.C, session *base.Session) error {
+	_, err := sh.resetTTL.Exec(session.Id(), sessionTTL(&sh.BaseSessionHolder, session))
+	return err
+}
+
+/*
+BindUser records that session belongs to userId, and saves it
+*/
+func (sh *JSONSessionHolder) BindUser(c web.C, r *http.Request, session *base.Session, userId string) error {
+	session.SetUser(userId, r.UserAgent())
+	return sh.Save(c, session)
+}
+
+/*
+UserSessions lists the user's sessions that have not expired, most recently used first
+*/
+func (sh *JSONSessionHolder) UserSessions(c web.C, userId string) ([]base.SessionInfo, error) {
+	rows, err := sh.userSessions.Query(userId)
+	if err != nil {
+		return nil, err
+	}
+	return scanSessionInfos(rows)
+}
+
+/*
+DestroyUserSessions destroys all the user's sessions
+*/
+func (sh *JSONSessionHolder) DestroyUserSessions(c web.C, userId string) error {
+	if _, err := sh.destroyUserSessions.Exec(userId); err != nil {
+		return err
+	}
+	if session, ok := base.SessionFromEnv(&c); ok && session.UserId == userId {
+		delete(c.Env, "session")
+	}
+	return nil
+}
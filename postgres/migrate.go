@@ -0,0 +1,127 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+const (
+	// Table recording the schema version of each set of migrations
+	SCHEMA_VERSIONS_TABLE = "tt_schema_versions"
+
+	// Migration set for the sessions table used by SessionHolder
+	SESSIONS_COMPONENT = "sessions"
+)
+
+/*
+Migration is one step in evolving a schema.  Its statements are run in a single transaction
+*/
+type Migration struct {
+	// Versions must be positive, and are applied in order
+	Version    int
+	Statements []string
+}
+
+// Migrations for the sessions table.  Later versions use IF NOT EXISTS as tables created by
+// earlier releases may already have the changes
+var sessionMigrations = []Migration{
+	{1, []string{TABLE_DEFINITION}},
+	{2, []string{
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS created_at timestamp with time zone`,
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS accessed_at timestamp with time zone`,
+	}},
+	{3, []string{
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS user_id text`,
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS user_agent text`,
+		`CREATE INDEX IF NOT EXISTS sessions_user_id ON sessions (user_id)`,
+	}},
+	{4, []string{`CREATE INDEX IF NOT EXISTS sessions_expires ON sessions (expires)`}},
+	{5, []string{`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 0`}},
+}
+
+/*
+Migrate brings the sessions table used by SessionHolder up to date.  NewSessionHolder calls this,
+but you can also call it separately, for example from a deployment script, so the application can
+run without permission to change the schema.
+*/
+func Migrate(db *sql.DB) error {
+	return RunMigrations(db, SESSIONS_COMPONENT, sessionMigrations)
+}
+
+/*
+RunMigrations applies the migrations with versions above the recorded version for component, in
+order, and records each version as it is applied.
+
+Each migration runs in its own transaction holding an advisory lock, so it is
+safe for several instances of an application to call this as they start.  The version is recorded
+in SCHEMA_VERSIONS_TABLE, which is created if necessary.
+*/
+func RunMigrations(db *sql.DB, component string, migrations []Migration) error {
+	migrations = append([]Migration(nil), migrations...)
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	if len(migrations) == 0 {
+		return nil
+	}
+
+	// Avoid taking locks and running DDL when we're already up to date
+	if version, err := SchemaVersion(db, component); err == nil && version >= migrations[len(migrations)-1].Version {
+		return nil
+	}
+
+	for _, migration := range migrations {
+		migration := migration
+		err := runTransaction(db, func(tx *sql.Tx) {
+			// One lock for all components, as they share the versions table
+			if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", SCHEMA_VERSIONS_TABLE); err != nil {
+				panic(err)
+			}
+			if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS ` + SCHEMA_VERSIONS_TABLE + ` (
+				component text PRIMARY KEY,
+				version integer NOT NULL,
+				updated_at timestamp with time zone NOT NULL
+			)`); err != nil {
+				panic(err)
+			}
+
+			var version int
+			err := tx.QueryRow("SELECT version FROM "+SCHEMA_VERSIONS_TABLE+" WHERE component=$1", component).Scan(&version)
+			if err != nil && err != sql.ErrNoRows {
+				panic(err)
+			}
+			if version >= migration.Version {
+				// Already applied, perhaps by another instance while we waited for the lock
+				return
+			}
+
+			for _, statement := range migration.Statements {
+				if _, err := tx.Exec(statement); err != nil {
+					panic(fmt.Errorf("migration %d of %s failed. %v", migration.Version, component, err))
+				}
+			}
+
+			if _, err := tx.Exec(`INSERT INTO `+SCHEMA_VERSIONS_TABLE+` (component, version, updated_at) VALUES ($1, $2, now())
+				ON CONFLICT (component) DO UPDATE SET version=EXCLUDED.version, updated_at=EXCLUDED.updated_at`,
+				component, migration.Version,
+			); err != nil {
+				panic(err)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+SchemaVersion returns the version of the last migration applied for component, or 0 if none have been
+*/
+func SchemaVersion(db *sql.DB, component string) (int, error) {
+	var version int
+	err := db.QueryRow("SELECT version FROM "+SCHEMA_VERSIONS_TABLE+" WHERE component=$1", component).Scan(&version)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return version, err
+}
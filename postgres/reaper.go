@@ -0,0 +1,159 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/philpearl/tt_goji_middleware/base"
+)
+
+const (
+	DEFAULT_REAP_INTERVAL   = 10 * time.Minute
+	DEFAULT_REAP_BATCH_SIZE = 1000
+)
+
+/*
+Reaper deletes expired sessions from a postgres session table in the background.  Sessions are
+deleted once they have been expired for longer than the session holder's ExpiryGrace.
+
+Create one with SessionHolder.NewReaper or JSONSessionHolder.NewReaper, then call Start.
+*/
+type Reaper struct {
+	// How often to look for expired sessions
+	Interval time.Duration
+	// Maximum number of sessions to delete in one transaction
+	BatchSize int
+	// Report is called after each run with the number of sessions deleted.  Defaults to logging
+	// the count when it is not zero
+	Report func(deleted int64, err error)
+
+	db    *sql.DB
+	table string
+	sh    *base.BaseSessionHolder
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+/*
+NewReaper creates a Reaper for the holder's sessions table
+*/
+func (sh *SessionHolder) NewReaper(interval time.Duration, batchSize int) *Reaper {
+	return newReaper(sh.db, "sessions", &sh.BaseSessionHolder, interval, batchSize)
+}
+
+/*
+NewReaper creates a Reaper for the holder's sessions table
+*/
+func (sh *JSONSessionHolder) NewReaper(interval time.Duration, batchSize int) *Reaper {
+	return newReaper(sh.db, sh.table, &sh.BaseSessionHolder, interval, batchSize)
+}
+
+func newReaper(db *sql.DB, table string, sh *base.BaseSessionHolder, interval time.Duration, batchSize int) *Reaper {
+	if interval <= 0 {
+		interval = DEFAULT_REAP_INTERVAL
+	}
+	if batchSize <= 0 {
+		batchSize = DEFAULT_REAP_BATCH_SIZE
+	}
+	return &Reaper{
+		Interval:  interval,
+		BatchSize: batchSize,
+		db:        db,
+		table:     table,
+		sh:        sh,
+	}
+}
+
+/*
+Start runs the reaper in the background.  It does nothing if the reaper is already running
+*/
+func (r *Reaper) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		return
+	}
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.run(r.stop, r.done)
+}
+
+/*
+Stop stops the background reaper, waiting for any run in progress to finish
+*/
+func (r *Reaper) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+	r.done = nil
+}
+
+func (r *Reaper) run(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			deleted, err := r.Reap()
+			r.report(deleted, err)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (r *Reaper) report(deleted int64, err error) {
+	if r.Report != nil {
+		r.Report(deleted, err)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete expired sessions from %s after deleting %d. %v", r.table, deleted, err)
+	} else if deleted > 0 {
+		log.Printf("Deleted %d expired sessions from %s", deleted, r.table)
+	}
+}
+
+/*
+Reap deletes all the sessions that have expired, in batches of BatchSize, and returns the number
+deleted.  The background reaper calls this every Interval
+*/
+func (r *Reaper) Reap() (int64, error) {
+	// SKIP LOCKED lets several instances of the application reap at once
+	query := fmt.Sprintf(`DELETE FROM %[1]s WHERE id IN (
+		SELECT id FROM %[1]s WHERE expires < now() - $2 * interval '1 second' LIMIT $1 FOR UPDATE SKIP LOCKED
+	)`, r.table)
+
+	var total int64
+	for {
+		var deleted int64
+		err := runTransaction(r.db, func(tx *sql.Tx) {
+			res, err := tx.Exec(query, r.BatchSize, r.sh.ExpiryGrace)
+			if err != nil {
+				panic(err)
+			}
+			deleted, err = res.RowsAffected()
+			if err != nil {
+				panic(err)
+			}
+		})
+		if err != nil {
+			return total, err
+		}
+		total += deleted
+		if deleted < int64(r.BatchSize) {
+			return total, nil
+		}
+	}
+}
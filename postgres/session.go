@@ -4,9 +4,11 @@ package postgres
 import (
 	"database/sql"
 	"net/http"
+	"time"
 
 	"github.com/philpearl/tt_goji_middleware/base"
 
+	"github.com/lib/pq"
 	"github.com/zenazn/goji/web"
 )
 
@@ -21,25 +23,41 @@ const (
 )
 
 /*
-SessionHolder is a Postgres-backed session store. It uses the postgres bytea data type and
-the gob encoding to store the session
+SessionHolder is a Postgres-backed session store. It stores sessions in a bytea column, encoded
+with Codec.  This is base.GobCodec unless you choose another with NewSessionHolderWithCodec.
+Sessions written by any registered codec, or before codecs were introduced, can be read.
+
+The expires column holds when each session expires.  Get reports ErrorSessionExpired for sessions
+that have expired within the last ExpiryGrace seconds, and ignores older ones.  Expired sessions
+are not deleted from the table unless you run a Reaper.  See NewReaper.
+
+SessionHolder implements base.UserSessionIndex using the indexed user_id column.
 */
 type SessionHolder struct {
 	base.BaseSessionHolder
-	db *sql.DB
+	Codec base.Codec
+	db    *sql.DB
 }
 
 /*
-NewSessionHolder creates a new postgres-backed session holder
+NewSessionHolder creates a new postgres-backed session holder, creating or updating the sessions
+table if necessary.  See Migrate
 */
 func NewSessionHolder(db *sql.DB) (base.SessionHolder, error) {
-	_, err := db.Exec(TABLE_DEFINITION)
-	if err != nil {
+	return NewSessionHolderWithCodec(db, base.GobCodec)
+}
+
+/*
+NewSessionHolderWithCodec creates a new postgres-backed session holder that encodes sessions with codec
+*/
+func NewSessionHolderWithCodec(db *sql.DB, codec base.Codec) (base.SessionHolder, error) {
+	if err := Migrate(db); err != nil {
 		return nil, err
 	}
 
 	return &SessionHolder{
 		BaseSessionHolder: base.NewBaseSessionHolder(DEFAULT_SESSION_TIMEOUT),
+		Codec:             codec,
 		db:                db,
 	}, nil
 }
@@ -54,12 +72,29 @@ func (sh *SessionHolder) Get(c web.C, r *http.Request) (*base.Session, error) {
 	}
 
 	var session base.Session
-	values := sessionValues{}
-
-	err := sh.db.QueryRow("SELECT content FROM sessions WHERE id=$1", sessionId).Scan(values)
+	var created, accessed pq.NullTime
+	var expired bool
+
+	err := sh.db.QueryRow(
+		`SELECT content, created_at, accessed_at, coalesce(expires < now(), false), coalesce(user_id, ''), coalesce(user_agent, ''), version
+		FROM sessions WHERE id=$1 AND (expires IS NULL OR expires >= now() - $2 * interval '1 second')`,
+		sessionId, sh.ExpiryGrace,
+	).Scan(sessionContent{session: &session}, &created, &accessed, &expired, &session.UserId, &session.UserAgent, &session.Version)
 	if err == nil {
-		session.Values = values
+		if session.Values == nil {
+			session.Values = make(map[string]interface{})
+		}
 		session.SetId(sessionId)
+		session.Created = created.Time
+		session.LastAccess = accessed.Time
+		if expired {
+			err = base.ErrorSessionExpired
+		} else if !created.Valid && sh.MaxLifetime > 0 {
+			// Stored before creation times were recorded, so its lifetime starts now.  Saving it
+			// records that
+			session.Created = time.Now()
+			session.SetDirty(true)
+		}
 	} else if err == sql.ErrNoRows {
 		err = base.ErrorSessionNotFound
 	}
@@ -78,20 +113,58 @@ func (sh *SessionHolder) Destroy(c web.C, session *base.Session) error {
 }
 
 /*
-Save a session to postgres
+Save a session to postgres.  Returns base.ErrorSessionConflict if the stored session has been
+saved since this one was loaded, and base.ErrorSessionNotFound if it has been destroyed since
 */
 func (sh *SessionHolder) Save(c web.C, session *base.Session) error {
 	sessionId := session.Id()
-
-	// There is a potential race here if the insert fails because the session exists, but it is deleted
-	// before we can update it.
-	_, err := sh.db.Exec("INSERT INTO sessions (id, content, expires) VALUES ($1, $2, now() + $3 * interval '1 second')", sessionId, sessionValues(session.Values), sh.Timeout)
-	if err != nil && isAlreadyExists(err, "sessions") {
-		_, err = sh.db.Exec("UPDATE sessions SET content=$2, expires=now() + $3 * interval '1 second' WHERE id=$1", sessionId, sessionValues(session.Values), sh.Timeout)
+	ttl := sessionTTL(&sh.BaseSessionHolder, session)
+	userId := nullString(session.UserId)
+	session.Version++
+
+	// Update the session only if it still has the version we loaded.  If nothing is updated the
+	// session is new, or has been saved or destroyed elsewhere.  Only new sessions are inserted,
+	// so a destroyed session isn't brought back
+	res, err := sh.db.Exec(
+		`UPDATE sessions SET content=$2, expires=now() + $3 * interval '1 second', accessed_at=now(), user_id=$4, user_agent=$5, version=$6,
+		created_at=COALESCE(created_at, now())
+		WHERE id=$1 AND version=$7`,
+		sessionId, sh.content(session), ttl, userId, session.UserAgent, session.Version, session.Version-1,
+	)
+	var updated int64
+	if err == nil {
+		updated, err = res.RowsAffected()
+	}
+	if err == nil && updated == 0 && session.Version > 1 {
+		err = sh.missingSession(sessionId)
+	} else if err == nil && updated == 0 {
+		_, err = sh.db.Exec(
+			`INSERT INTO sessions (id, content, expires, created_at, accessed_at, user_id, user_agent, version)
+			VALUES ($1, $2, now() + $3 * interval '1 second', $4, now(), $5, $6, $7)`,
+			sessionId, sh.content(session), ttl, session.Created, userId, session.UserAgent, session.Version,
+		)
+		if isAlreadyExists(err, "sessions") {
+			err = base.ErrorSessionConflict
+		}
+	}
+	if err != nil {
+		session.Version--
 	}
 	return err
 }
 
+// missingSession says why a session that was loaded couldn't be updated
+func (sh *SessionHolder) missingSession(sessionId string) error {
+	var exists bool
+	if err := sh.db.QueryRow("SELECT EXISTS (SELECT 1 FROM sessions WHERE id=$1)", sessionId).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return base.ErrorSessionConflict
+	}
+	return base.ErrorSessionNotFound
+}
+
 func (sh *SessionHolder) RegenerateId(c web.C, session *base.Session) (string, error) {
 	sessionId := session.Id()
 	newSessionId := sh.GenerateSessionId()
@@ -109,7 +182,50 @@ func (sh *SessionHolder) RegenerateId(c web.C, session *base.Session) (string, e
 }
 
 func (sh *SessionHolder) ResetTTL(c web.C, session *base.Session) error {
-	// Need to implement a TTL...
-	_, err := sh.db.Exec("UPDATE sessions SET expires=now()+$2 * interval '1 second' WHERE id=$1", session.Id(), sh.Timeout)
+	_, err := sh.db.Exec("UPDATE sessions SET expires=now()+$2 * interval '1 second', accessed_at=now() WHERE id=$1", session.Id(), sessionTTL(&sh.BaseSessionHolder, session))
 	return err
 }
+
+/*
+BindUser records that session belongs to userId, and saves it
+*/
+func (sh *SessionHolder) BindUser(c web.C, r *http.Request, session *base.Session, userId string) error {
+	session.SetUser(userId, r.UserAgent())
+	return sh.Save(c, session)
+}
+
+/*
+UserSessions lists the user's sessions that have not expired, most recently used first
+*/
+func (sh *SessionHolder) UserSessions(c web.C, userId string) ([]base.SessionInfo, error) {
+	rows, err := sh.db.Query(
+		`SELECT rtrim(id), created_at, accessed_at, coalesce(user_agent, '') FROM sessions
+		WHERE user_id=$1 AND (expires IS NULL OR expires >= now())
+		ORDER BY accessed_at DESC`, userId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanSessionInfos(rows)
+}
+
+/*
+DestroyUserSessions destroys all the user's sessions
+*/
+func (sh *SessionHolder) DestroyUserSessions(c web.C, userId string) error {
+	if _, err := sh.db.Exec("DELETE FROM sessions WHERE user_id=$1", userId); err != nil {
+		return err
+	}
+	if session, ok := base.SessionFromEnv(&c); ok && session.UserId == userId {
+		delete(c.Env, "session")
+	}
+	return nil
+}
+
+func (sh *SessionHolder) content(session *base.Session) sessionContent {
+	codec := sh.Codec
+	if codec == nil {
+		codec = base.GobCodec
+	}
+	return sessionContent{codec: codec, session: session}
+}
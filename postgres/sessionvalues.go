@@ -7,6 +7,8 @@ import (
 	"encoding/hex"
 	"fmt"
 	"strings"
+
+	"github.com/philpearl/tt_goji_middleware/base"
 )
 
 type sessionValues map[string]interface{}
@@ -17,25 +19,22 @@ func init() {
 	gob.Register(map[string]interface{}{})
 }
 
-// Value() converts a product into a string suitable for the SQL database
-//
-// It encodes the data using Gob, then converts to a hex string suitable for the
-// bytea type
-func (p sessionValues) Value() (driver.Value, error) {
-	buf := bytes.Buffer{}
-	encoder := gob.NewEncoder(&buf)
-	err := encoder.Encode(p)
-	if err != nil {
-		return nil, err
-	}
+// sessionContent converts a session to and from the content column
+type sessionContent struct {
+	codec   base.Codec
+	session *base.Session
+}
 
-	return `E'\\x` + hex.EncodeToString(buf.Bytes()) + `'`, nil
+// Value() encodes the session with the codec, for storing in the bytea content column
+func (p sessionContent) Value() (driver.Value, error) {
+	return base.EncodeSession(p.codec, p.session)
 }
 
-// Scan() pulls the product out of the SQL database
+// Scan() decodes the session from the content column.
 //
-// It expects the data to be in a bytea field, and encoded using GOB
-func (p sessionValues) Scan(src interface{}) error {
+// Content written with any registered codec can be read, as can the hex-encoded gob written
+// before codecs were introduced
+func (p sessionContent) Scan(src interface{}) error {
 	if src == nil {
 		return nil
 	}
@@ -45,11 +44,23 @@ func (p sessionValues) Scan(src interface{}) error {
 		return fmt.Errorf("expected session values to be a byte array")
 	}
 
-	bs := string(b)
-	if strings.HasPrefix(bs, `E'\\x`) && strings.HasSuffix(bs, `'`) {
-		bs = bs[5 : len(bs)-1]
+	if bytes.HasPrefix(b, []byte(`E'\`)) {
+		values := sessionValues{}
+		if err := values.scanLegacy(string(b)); err != nil {
+			return err
+		}
+		p.session.Values = values
+		return nil
+	}
+	return base.DecodeSession(b, p.session)
+}
 
-		g, err := hex.DecodeString(bs)
+// scanLegacy decodes values stored as a hex string literal of gob-encoded data.  Depending on how
+// the literal was stored it may have one or two backslashes
+func (p sessionValues) scanLegacy(bs string) error {
+	hexString := strings.TrimLeft(strings.TrimPrefix(bs, `E'`), `\`)
+	if strings.HasPrefix(hexString, "x") && strings.HasSuffix(hexString, `'`) {
+		g, err := hex.DecodeString(hexString[1 : len(hexString)-1])
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,51 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/philpearl/tt_goji_middleware/base"
+)
+
+func TestSessionContentFlashes(t *testing.T) {
+	for _, codec := range []base.Codec{base.GobCodec, base.JSONCodec, base.BinaryCodec} {
+		s := base.Session{Values: map[string]interface{}{}}
+		s.AddFlash(base.FlashInfo, "welcome back")
+
+		v, err := sessionContent{codec: codec, session: &s}.Value()
+		if err != nil {
+			t.Fatalf("failed to encode session values - %v", err)
+		}
+
+		var s1 base.Session
+		if err := (sessionContent{session: &s1}).Scan(v.([]byte)); err != nil {
+			t.Fatalf("failed to decode session values - %v", err)
+		}
+
+		flashes := s1.Flashes()
+		if !reflect.DeepEqual(flashes, []base.Flash{{Category: base.FlashInfo, Message: "welcome back"}}) {
+			t.Fatalf("flashes not as expected. Have %v", flashes)
+		}
+	}
+}
+
+func TestSessionContentLegacy(t *testing.T) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(sessionValues{"cheese": "wensleydale"}); err != nil {
+		t.Fatalf("failed to encode - %v", err)
+	}
+
+	for _, prefix := range []string{`E'\x`, `E'\\x`} {
+		var s base.Session
+		legacy := prefix + hex.EncodeToString(buf.Bytes()) + `'`
+		if err := (sessionContent{session: &s}).Scan([]byte(legacy)); err != nil {
+			t.Fatalf("failed to decode legacy session values - %v", err)
+		}
+		if cheese, _ := s.Get("cheese"); cheese != "wensleydale" {
+			t.Fatalf("cheese is %v", cheese)
+		}
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"database/sql"
 	"log"
 	"runtime"
+	"time"
+
+	"github.com/philpearl/tt_goji_middleware/base"
 
 	"github.com/lib/pq"
 )
@@ -47,3 +50,34 @@ func isAlreadyExists(err error, table string) bool {
 	}
 	return false
 }
+
+// sessionTTL returns the number of seconds until the session expires if it is accessed now.  NULL
+// means it never expires
+func sessionTTL(sh *base.BaseSessionHolder, session *base.Session) sql.NullInt64 {
+	session.LastAccess = time.Now()
+	ttl := sh.SessionTTL(session, session.LastAccess)
+	return sql.NullInt64{Int64: int64(ttl), Valid: ttl > 0}
+}
+
+// nullString converts empty strings to NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// scanSessionInfos reads rows of id, created_at, accessed_at and user_agent
+func scanSessionInfos(rows *sql.Rows) ([]base.SessionInfo, error) {
+	defer rows.Close()
+
+	var infos []base.SessionInfo
+	for rows.Next() {
+		var info base.SessionInfo
+		var created, accessed pq.NullTime
+		if err := rows.Scan(&info.Id, &created, &accessed, &info.UserAgent); err != nil {
+			return nil, err
+		}
+		info.Created = created.Time
+		info.LastAccess = accessed.Time
+		infos = append(infos, info)
+	}
+	return infos, rows.Err()
+}
@@ -0,0 +1,521 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const (
+	// Number of hash slots in a Redis Cluster
+	CLUSTER_SLOTS = 16384
+
+	// How many MOVED or ASK redirections to follow for one command
+	MAX_CLUSTER_REDIRECTS = 5
+
+	// Minimum time between reloads of the slot map after MOVED replies
+	CLUSTER_REFRESH_INTERVAL = time.Second
+)
+
+var (
+	ErrorNoClusterNodes error = errors.New("no redis cluster node could be reached")
+	ErrorConnClosed     error = errors.New("redis cluster connection closed")
+)
+
+/*
+KeySlot returns the Redis Cluster hash slot for key.  If the key contains a hash tag, a non-empty
+string between { and the next }, only the tag is hashed, so keys with the same tag are in the same
+slot.
+*/
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % CLUSTER_SLOTS
+}
+
+/*
+HashTag wraps s in braces so keys built from it are all in the same cluster slot
+*/
+func HashTag(s string) string {
+	return "{" + s + "}"
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum used for cluster slots
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+/*
+cluster keeps the map of which node serves each hash slot.  It is shared by all the connections
+from a pool, and refreshed from CLUSTER SLOTS when a node says a slot has moved.
+*/
+type cluster struct {
+	seeds   []string
+	options []redigo.DialOption
+
+	mu     sync.RWMutex
+	slots  [CLUSTER_SLOTS]string
+	loaded bool
+	// The reload in progress, if any, and when the last one started
+	reload    *clusterReload
+	refreshed time.Time
+}
+
+// clusterReload is a reload of the slot map that other connections can wait for
+type clusterReload struct {
+	done chan struct{}
+	err  error
+}
+
+func newCluster(opts *RedisOptions) *cluster {
+	return &cluster{
+		seeds:   append([]string(nil), opts.ClusterAddrs...),
+		options: opts.dialOptions(),
+	}
+}
+
+// refresh reloads the slot map from the first node that answers.  Only one reload runs at a time,
+// and callers that arrive meanwhile wait for it
+func (cl *cluster) refresh() error {
+	cl.mu.Lock()
+	if l := cl.reload; l != nil {
+		cl.mu.Unlock()
+		<-l.done
+		return l.err
+	}
+	l := &clusterReload{done: make(chan struct{})}
+	cl.reload = l
+	cl.refreshed = time.Now()
+	addrs := append([]string(nil), cl.seeds...)
+	if cl.loaded {
+		// Nodes we know about now may answer when the seeds don't
+		known := map[string]bool{}
+		for _, addr := range cl.slots {
+			if addr != "" && !known[addr] {
+				known[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	cl.mu.Unlock()
+
+	l.err = ErrorNoClusterNodes
+	for _, addr := range addrs {
+		var slots [CLUSTER_SLOTS]string
+		if slots, l.err = cl.loadSlots(addr); l.err == nil {
+			cl.mu.Lock()
+			cl.slots = slots
+			cl.loaded = true
+			cl.mu.Unlock()
+			break
+		}
+	}
+
+	cl.mu.Lock()
+	cl.reload = nil
+	cl.mu.Unlock()
+	close(l.done)
+	return l.err
+}
+
+// loadSlots asks one node for the slot map
+func (cl *cluster) loadSlots(addr string) (slots [CLUSTER_SLOTS]string, err error) {
+	conn, err := redigo.Dial("tcp", addr, cl.options...)
+	if err != nil {
+		return slots, err
+	}
+	defer conn.Close()
+	ranges, err := redigo.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return slots, err
+	}
+
+	for _, r := range ranges {
+		// Each range is start, end, then the master and replicas as host, port, ...
+		info, err := redigo.Values(r, nil)
+		if err != nil || len(info) < 3 {
+			return slots, fmt.Errorf("unexpected CLUSTER SLOTS reply %v", r)
+		}
+		start, _ := redigo.Int(info[0], nil)
+		end, _ := redigo.Int(info[1], nil)
+		master, err := redigo.Values(info[2], nil)
+		if err != nil || len(master) < 2 || start < 0 || end >= CLUSTER_SLOTS {
+			return slots, fmt.Errorf("unexpected CLUSTER SLOTS reply %v", r)
+		}
+		host, _ := redigo.String(master[0], nil)
+		port, _ := redigo.Int(master[1], nil)
+		if host == "" {
+			// The node we asked
+			host, _, _ = net.SplitHostPort(addr)
+		}
+		node := net.JoinHostPort(host, strconv.Itoa(port))
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = node
+		}
+	}
+	return slots, nil
+}
+
+// node returns the address of the node serving slot.  A slot of -1 means any node
+func (cl *cluster) node(slot int) (string, error) {
+	cl.mu.RLock()
+	loaded := cl.loaded
+	cl.mu.RUnlock()
+	if !loaded {
+		if err := cl.refresh(); err != nil {
+			return "", err
+		}
+	}
+
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	if slot >= 0 && cl.slots[slot] != "" {
+		return cl.slots[slot], nil
+	}
+	for _, addr := range cl.slots {
+		if addr != "" {
+			return addr, nil
+		}
+	}
+	return cl.seeds[0], nil
+}
+
+// moved records that slot is now served by addr.  Other slots have probably moved too, so the
+// rest of the map is reloaded in the background, at most once every CLUSTER_REFRESH_INTERVAL
+func (cl *cluster) moved(slot int, addr string) {
+	cl.mu.Lock()
+	cl.slots[slot] = addr
+	due := cl.reload == nil && time.Since(cl.refreshed) >= CLUSTER_REFRESH_INTERVAL
+	if due {
+		cl.refreshed = time.Now()
+	}
+	cl.mu.Unlock()
+	if due {
+		go cl.refresh()
+	}
+}
+
+func (cl *cluster) dial() (redigo.Conn, error) {
+	return &clusterConn{cluster: cl, conns: map[string]redigo.Conn{}}, nil
+}
+
+type command struct {
+	name string
+	args []interface{}
+}
+
+/*
+clusterConn is a redigo.Conn that sends each command to the cluster node serving its key.  It
+holds a connection to each node it has used.
+
+Commands queued with Send are sent together, to the node serving the first of them that has a
+key, when Do or Flush is called.  So a MULTI ... EXEC transaction goes to one node, and its keys
+must all be in one slot.  After WATCH, or within MULTI, commands go to the same node until EXEC,
+DISCARD or UNWATCH.  MOVED and ASK redirections are followed, except when they would break a WATCH.
+*/
+type clusterConn struct {
+	cluster *cluster
+	conns   map[string]redigo.Conn
+
+	pending   []command
+	pinned    string
+	receiving redigo.Conn
+	err       error
+}
+
+func (c *clusterConn) Close() error {
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	c.conns = nil
+	c.err = ErrorConnClosed
+	return nil
+}
+
+func (c *clusterConn) Err() error {
+	return c.err
+}
+
+func (c *clusterConn) Send(commandName string, args ...interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.pending = append(c.pending, command{commandName, args})
+	return nil
+}
+
+func (c *clusterConn) Flush() error {
+	if c.err != nil {
+		return c.err
+	}
+	cmds := c.pending
+	c.pending = nil
+	if len(cmds) == 0 {
+		return nil
+	}
+	addr, err := c.route(cmds)
+	if err != nil {
+		return err
+	}
+	conn, err := c.conn(addr)
+	if err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		conn.Send(cmd.name, cmd.args...)
+	}
+	c.receiving = conn
+	c.track(addr, cmds)
+	return c.checkConn(addr, conn, conn.Flush())
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	if c.receiving == nil {
+		return nil, errors.New("redis cluster connection has nothing to receive")
+	}
+	return c.receiving.Receive()
+}
+
+func (c *clusterConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	cmds := c.pending
+	c.pending = nil
+	if commandName != "" {
+		cmds = append(cmds, command{commandName, args})
+	}
+	if len(cmds) == 0 {
+		// Read any replies from Flush
+		if c.receiving != nil {
+			receiving := c.receiving
+			c.receiving = nil
+			return receiving.Do("")
+		}
+		return nil, nil
+	}
+
+	redirectable := c.pinned == ""
+	addr, err := c.route(cmds)
+	if err != nil {
+		return nil, err
+	}
+	asking := false
+	for redirects := 0; ; redirects++ {
+		conn, err := c.conn(addr)
+		if err != nil {
+			return nil, err
+		}
+		for _, cmd := range cmds[:len(cmds)-1] {
+			if asking {
+				conn.Send("ASKING")
+			}
+			conn.Send(cmd.name, cmd.args...)
+		}
+		if asking {
+			conn.Send("ASKING")
+		}
+		last := cmds[len(cmds)-1]
+		reply, err := conn.Do(last.name, last.args...)
+		if err = c.checkConn(addr, conn, err); err != nil {
+			if redirectable && redirects < MAX_CLUSTER_REDIRECTS {
+				if slot, target, ask, ok := redirection(err); ok {
+					if !ask {
+						c.cluster.moved(slot, target)
+					}
+					addr, asking = target, ask
+					continue
+				}
+			}
+		}
+		c.track(addr, cmds)
+		return reply, err
+	}
+}
+
+// route picks the node for a batch of commands
+func (c *clusterConn) route(cmds []command) (string, error) {
+	if c.pinned != "" {
+		return c.pinned, nil
+	}
+	for _, cmd := range cmds {
+		if key, ok := commandKey(cmd); ok {
+			return c.cluster.node(KeySlot(key))
+		}
+	}
+	return c.cluster.node(-1)
+}
+
+// track notes when commands start or end a WATCH or MULTI, which keep us on one node
+func (c *clusterConn) track(addr string, cmds []command) {
+	for _, cmd := range cmds {
+		switch strings.ToUpper(cmd.name) {
+		case "WATCH", "MULTI":
+			c.pinned = addr
+		case "EXEC", "DISCARD", "UNWATCH":
+			c.pinned = ""
+		}
+	}
+}
+
+// conn returns our connection to a node, connecting if necessary
+func (c *clusterConn) conn(addr string) (redigo.Conn, error) {
+	if conn, ok := c.conns[addr]; ok {
+		return conn, nil
+	}
+	conn, err := redigo.Dial("tcp", addr, c.cluster.options...)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[addr] = conn
+	return conn, nil
+}
+
+// checkConn drops the connection to a node if it has failed, so the next command reconnects.  The
+// slot map is reloaded, as the node may have been replaced
+func (c *clusterConn) checkConn(addr string, conn redigo.Conn, err error) error {
+	if conn.Err() != nil {
+		conn.Close()
+		delete(c.conns, addr)
+		if c.pinned == addr {
+			c.pinned = ""
+		}
+		if c.receiving == conn {
+			c.receiving = nil
+		}
+		c.cluster.refresh()
+	}
+	return err
+}
+
+// redirection parses MOVED and ASK errors, which look like "MOVED 3999 127.0.0.1:6381"
+func redirection(err error) (slot int, addr string, ask bool, ok bool) {
+	rerr, isRedis := err.(redigo.Error)
+	if !isRedis {
+		return 0, "", false, false
+	}
+	fields := strings.Fields(string(rerr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return 0, "", false, false
+	}
+	slot, serr := strconv.Atoi(fields[1])
+	if serr != nil || slot < 0 || slot >= CLUSTER_SLOTS {
+		return 0, "", false, false
+	}
+	return slot, fields[2], fields[0] == "ASK", true
+}
+
+// Commands that don't take a key as their first argument
+var keylessCommands = map[string]bool{
+	"ASKING": true, "AUTH": true, "CLUSTER": true, "DISCARD": true, "ECHO": true, "EXEC": true,
+	"INFO": true, "MULTI": true, "PING": true, "SCRIPT": true, "SELECT": true, "TIME": true,
+	"UNWATCH": true,
+}
+
+// commandKey returns the key a command acts on, if any
+func commandKey(cmd command) (string, bool) {
+	name := strings.ToUpper(cmd.name)
+	args := cmd.args
+	switch {
+	case keylessCommands[name]:
+		return "", false
+	case name == "EVAL" || name == "EVALSHA":
+		// script, number of keys, keys...
+		if len(args) < 3 {
+			return "", false
+		}
+		if n, err := strconv.Atoi(fmt.Sprint(args[1])); err != nil || n == 0 {
+			return "", false
+		}
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		return "", false
+	}
+	switch key := args[0].(type) {
+	case string:
+		return key, true
+	case []byte:
+		return string(key), true
+	default:
+		return fmt.Sprint(key), true
+	}
+}
+
+// groupBySlot splits commands into groups whose keys are in the same cluster slot, keeping their
+// order within each group.  Commands without keys go with the command before them
+func groupBySlot(cmds []command) [][]command {
+	var groups [][]command
+	index := map[int]int{}
+	current := -1
+	for _, cmd := range cmds {
+		if key, ok := commandKey(cmd); ok {
+			slot := KeySlot(key)
+			i, ok := index[slot]
+			if !ok {
+				i = len(groups)
+				index[slot] = i
+				groups = append(groups, nil)
+			}
+			current = i
+		} else if current < 0 {
+			current = 0
+			groups = append(groups, nil)
+		}
+		groups[current] = append(groups[current], cmd)
+	}
+	return groups
+}
+
+// renameKey renames a key.  In a cluster, if the new name is in a different slot RENAME would
+// fail.  Instead the key is copied with DUMP and RESTORE, keeping its TTL, and the original is
+// deleted
+func renameKey(conn redigo.Conn, cluster bool, from, to string) error {
+	if !cluster || KeySlot(from) == KeySlot(to) {
+		_, err := conn.Do("RENAME", from, to)
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DUMP", from)
+	conn.Send("PTTL", from)
+	rsp, err := redigo.Values(conn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	if rsp[0] == nil {
+		return redigo.Error("ERR no such key")
+	}
+	pttl, err := redigo.Int64(rsp[1], nil)
+	if err != nil {
+		return err
+	}
+	if pttl < 0 {
+		pttl = 0
+	}
+	if _, err := conn.Do("RESTORE", to, pttl, rsp[0]); err != nil {
+		return err
+	}
+	_, err = conn.Do("DEL", from)
+	return err
+}
@@ -0,0 +1,255 @@
+package redis
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+func TestKeySlot(t *testing.T) {
+	if slot := KeySlot("123456789"); slot != 0x31c3 {
+		t.Fatalf("slot is %d", slot)
+	}
+	if slot := KeySlot("foo"); slot != 12182 {
+		t.Fatalf("slot is %d", slot)
+	}
+	if KeySlot("sess:"+HashTag("wallace")) != KeySlot("usersess:"+HashTag("wallace")) {
+		t.Fatalf("keys with the same hash tag should be in the same slot")
+	}
+	if KeySlot("{}cheese") != int(crc16("{}cheese"))%CLUSTER_SLOTS {
+		t.Fatalf("empty hash tags should be ignored")
+	}
+}
+
+// fakeCluster is two stand-in cluster nodes.  Node 0 serves the lower half of the slots and node
+// 1 the upper half, unless a slot is in moved
+type fakeCluster struct {
+	nodes [2]*fakeRedis
+
+	mu    sync.Mutex
+	moved map[int]int
+	ask   map[int]int
+}
+
+func startFakeCluster(t *testing.T) *fakeCluster {
+	fc := &fakeCluster{moved: map[int]int{}, ask: map[int]int{}}
+	for i := range fc.nodes {
+		i := i
+		fc.nodes[i] = startFakeRedis(t, func(args []string) string { return fc.reply(i, args) })
+	}
+	return fc
+}
+
+func (fc *fakeCluster) Close() {
+	for _, node := range fc.nodes {
+		node.Close()
+	}
+}
+
+func (fc *fakeCluster) owner(slot int) int {
+	if owner, ok := fc.moved[slot]; ok {
+		return owner
+	}
+	return slot * 2 / CLUSTER_SLOTS
+}
+
+func (fc *fakeCluster) reply(node int, args []string) string {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	switch args[0] {
+	case "CLUSTER":
+		return fc.slotsReply()
+	case "ASKING", "MULTI":
+		return "+OK\r\n"
+	case "EXEC":
+		return "*0\r\n"
+	}
+	key := args[1]
+	if args[0] == "EVALSHA" {
+		key = args[3]
+	}
+	slot := KeySlot(key)
+	if target, ok := fc.ask[slot]; ok {
+		if target == node {
+			// Importing the slot.  The test checks ASKING was sent
+			return "+OK\r\n"
+		}
+		return fmt.Sprintf("-ASK %d %s\r\n", slot, fc.nodes[target].Addr())
+	}
+	if owner := fc.owner(slot); owner != node {
+		return fmt.Sprintf("-MOVED %d %s\r\n", slot, fc.nodes[owner].Addr())
+	}
+	return "+OK\r\n"
+}
+
+func (fc *fakeCluster) slotsReply() string {
+	// Report each slot as its own range so moved slots are included
+	var ranges []string
+	for start := 0; start < CLUSTER_SLOTS; {
+		end := start
+		for end+1 < CLUSTER_SLOTS && fc.owner(end+1) == fc.owner(start) {
+			end++
+		}
+		host, port, _ := net.SplitHostPort(fc.nodes[fc.owner(start)].Addr().String())
+		ranges = append(ranges, fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n", start, end, len(host), host, port))
+		start = end + 1
+	}
+	reply := fmt.Sprintf("*%d\r\n", len(ranges))
+	for _, r := range ranges {
+		reply += r
+	}
+	return reply
+}
+
+func lastCommand(f *fakeRedis) []string {
+	commands := f.received()
+	if len(commands) == 0 {
+		return nil
+	}
+	return commands[len(commands)-1]
+}
+
+func TestClusterConn(t *testing.T) {
+	fc := startFakeCluster(t)
+	defer fc.Close()
+
+	pool, err := NewPool(RedisOptions{ClusterAddrs: []string{fc.nodes[1].Addr().String()}})
+	if err != nil {
+		t.Fatalf("failed to build pool - %v", err)
+	}
+	defer pool.Close()
+	conn := pool.Get()
+	defer conn.Close()
+
+	// "foo" and "cheese" are in the upper half of the slots, "brie" in the lower
+	for _, key := range []string{"foo", "cheese", "brie"} {
+		node := fc.nodes[KeySlot(key)*2/CLUSTER_SLOTS]
+		if _, err := conn.Do("SET", key, "stilton"); err != nil {
+			t.Fatalf("SET %s failed - %v", key, err)
+		}
+		if cmd := lastCommand(node); !reflect.DeepEqual(cmd, []string{"SET", key, "stilton"}) {
+			t.Fatalf("expected SET %s on node serving it, have %v", key, cmd)
+		}
+	}
+
+	// Transactions go to the node of their keys
+	conn.Send("MULTI")
+	conn.Send("SET", "foo", "brie")
+	if _, err := conn.Do("EXEC"); err != nil {
+		t.Fatalf("transaction failed - %v", err)
+	}
+	commands := fc.nodes[1].received()
+	if !reflect.DeepEqual(commands[len(commands)-3:], [][]string{{"MULTI"}, {"SET", "foo", "brie"}, {"EXEC"}}) {
+		t.Fatalf("transaction not sent together, %v", commands)
+	}
+
+	// Slots that have moved are followed
+	fc.mu.Lock()
+	fc.moved[KeySlot("foo")] = 0
+	fc.mu.Unlock()
+	if _, err := conn.Do("SET", "foo", "brie"); err != nil {
+		t.Fatalf("SET after move failed - %v", err)
+	}
+	if cmd := lastCommand(fc.nodes[0]); !reflect.DeepEqual(cmd, []string{"SET", "foo", "brie"}) {
+		t.Fatalf("expected SET on new node, have %v", cmd)
+	}
+
+	// Slots being migrated are asked for on the new node, without updating the slot map
+	slot := KeySlot("brie")
+	fc.mu.Lock()
+	fc.ask[slot] = 1
+	fc.mu.Unlock()
+	if _, err := conn.Do("SET", "brie", "gouda"); err != nil {
+		t.Fatalf("SET after ASK failed - %v", err)
+	}
+	commands = fc.nodes[1].received()
+	if !reflect.DeepEqual(commands[len(commands)-2:], [][]string{{"ASKING"}, {"SET", "brie", "gouda"}}) {
+		t.Fatalf("expected ASKING then SET, have %v", commands[len(commands)-2:])
+	}
+	fc.mu.Lock()
+	delete(fc.ask, slot)
+	fc.mu.Unlock()
+	if _, err := conn.Do("SET", "brie", "feta"); err != nil {
+		t.Fatalf("SET failed - %v", err)
+	}
+	if cmd := lastCommand(fc.nodes[0]); !reflect.DeepEqual(cmd, []string{"SET", "brie", "feta"}) {
+		t.Fatalf("expected SET on original node, have %v", cmd)
+	}
+
+	// Scripts are routed by their first key
+	script := redigo.NewScript(1, "return 1")
+	script.Do(conn, "brie")
+	if cmd := lastCommand(fc.nodes[0]); len(cmd) < 3 || cmd[0] != "EVALSHA" || cmd[2] != "1" || cmd[3] != "brie" {
+		t.Fatalf("expected script on node serving its key, have %v", cmd)
+	}
+}
+
+func TestGroupBySlot(t *testing.T) {
+	cmds := []command{
+		{"SET", []interface{}{"sess:{s1}", "cheddar"}},
+		{"SADD", []interface{}{"usersess:{wallace}", "s1"}},
+		{"EXPIRE", []interface{}{"sess:{s1}", 60}},
+		{"EXPIRE", []interface{}{"usersess:{wallace}", 60}},
+	}
+	groups := groupBySlot(cmds)
+	expected := [][]command{{cmds[0], cmds[2]}, {cmds[1], cmds[3]}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("groups are %v", groups)
+	}
+}
+
+func TestClusterMoved(t *testing.T) {
+	fc := startFakeCluster(t)
+	defer fc.Close()
+	slotsRequests := func() int {
+		var n int
+		for _, node := range fc.nodes {
+			for _, cmd := range node.received() {
+				if cmd[0] == "CLUSTER" {
+					n++
+				}
+			}
+		}
+		return n
+	}
+
+	cl := newCluster(&RedisOptions{ClusterAddrs: []string{fc.nodes[0].Addr().String()}})
+	if err := cl.refresh(); err != nil {
+		t.Fatalf("failed to load slots - %v", err)
+	}
+	cl.mu.Lock()
+	cl.refreshed = time.Time{}
+	cl.mu.Unlock()
+
+	// Lots of MOVED replies at once patch the map straight away, and reload it only once
+	target := fc.nodes[1].Addr().String()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cl.moved(KeySlot("brie"), target)
+		}()
+	}
+	wg.Wait()
+	if addr, _ := cl.node(KeySlot("brie")); addr != target {
+		t.Fatalf("slot not patched, have %s", addr)
+	}
+	for i := 0; i < 100; i++ {
+		cl.mu.RLock()
+		reloading := cl.reload != nil
+		cl.mu.RUnlock()
+		if !reloading {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := slotsRequests(); n > 2 {
+		t.Fatalf("expected at most one reload after MOVED, have %d CLUSTER SLOTS", n-1)
+	}
+}
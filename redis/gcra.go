@@ -0,0 +1,267 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/zenazn/goji/web"
+)
+
+var (
+	ErrorInvalidRate error = errors.New("rate limit needs a positive rate and period, a burst of at least 0, and no more than one request a microsecond")
+)
+
+/*
+GCRALimiter limits the rate of requests using the Generic Cell Rate Algorithm.  It allows a
+sustained rate of requests, plus a burst of extra requests at once, and stores a single timestamp
+in redis for each key.  Build one with NewGCRALimiter.
+
+The limiter can be used directly, for example to throttle outbound email, or as middleware via
+BuildGCRAMiddleWare.
+*/
+type GCRALimiter struct {
+	rate   int
+	period time.Duration
+	burst  int
+
+	// Time between requests at the sustained rate, in microseconds
+	interval int64
+}
+
+/*
+GCRAResult says whether a request was allowed by a GCRALimiter
+*/
+type GCRAResult struct {
+	Allowed bool
+	// Limit is the number of requests that can be made at once: the burst plus one
+	Limit int
+	// Remaining is how many more requests can be made now
+	Remaining int
+	// RetryAfter is how long to wait before a request will be allowed.  Zero if this one was
+	RetryAfter time.Duration
+	// ResetAfter is how long until the limiter is back to allowing a full burst
+	ResetAfter time.Duration
+}
+
+/*
+NewGCRALimiter creates a limiter that allows rate requests every period, with bursts of up to
+burst requests over that rate.  So 100 requests a minute with bursts of 20 is
+
+	limiter, err := redis.NewGCRALimiter(100, time.Minute, 20)
+
+Requests are spread evenly: in this example once the burst is used up a request is allowed every
+0.6 seconds.
+*/
+func NewGCRALimiter(rate int, period time.Duration, burst int) (*GCRALimiter, error) {
+	if rate <= 0 || period <= 0 || burst < 0 {
+		return nil, ErrorInvalidRate
+	}
+	interval := int64(period/time.Microsecond) / int64(rate)
+	if interval < 1 {
+		return nil, ErrorInvalidRate
+	}
+	return &GCRALimiter{
+		rate:     rate,
+		period:   period,
+		burst:    burst,
+		interval: interval,
+	}, nil
+}
+
+/*
+gcraScript applies the Generic Cell Rate Algorithm to a key holding the theoretical arrival time
+(TAT) of the next request, in microseconds.
+
+KEYS[1] is the key.  ARGV[1] is the time between requests in microseconds and ARGV[2] the burst.
+This must match GCRALimiter.decide.
+
+Returns whether the request is allowed (1 or 0), the requests remaining, and the microseconds to
+wait before retrying and until the limiter is reset.  Times come from the redis server so all
+clients agree.
+*/
+var gcraScript = redigo.NewScript(1, `
+if redis.replicate_commands then redis.replicate_commands() end
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+
+local tat = tonumber(redis.call('GET', KEYS[1])) or now
+if tat < now then
+	tat = now
+end
+local allow_at = tat - interval * burst
+if now < allow_at then
+	return {0, 0, allow_at - now, tat - now}
+end
+
+local new_tat = tat + interval
+redis.call('SET', KEYS[1], string.format('%d', new_tat), 'PX', string.format('%d', math.ceil((new_tat - now) / 1000)))
+return {1, math.floor((now - allow_at) / interval), 0, new_tat - now}
+`)
+
+/*
+Allow decides whether a request on key is allowed, and records it if it is.  Keys are used as
+they are: see NamespacedKey to put them in a namespace.
+*/
+func (l *GCRALimiter) Allow(conn redigo.Conn, key string) (GCRAResult, error) {
+	rsp, err := redigo.Int64s(gcraScript.Do(conn, key, l.interval, l.burst))
+	if err != nil {
+		return GCRAResult{}, err
+	}
+	if len(rsp) != 4 {
+		return GCRAResult{}, fmt.Errorf("unexpected reply from GCRA script, %v", rsp)
+	}
+	return GCRAResult{
+		Allowed:    rsp[0] == 1,
+		Limit:      l.burst + 1,
+		Remaining:  int(rsp[1]),
+		RetryAfter: time.Duration(rsp[2]) * time.Microsecond,
+		ResetAfter: time.Duration(rsp[3]) * time.Microsecond,
+	}, nil
+}
+
+// decide applies the algorithm for a request at now to a key with theoretical arrival time tat,
+// both in microseconds, as gcraScript does.  Returns the new tat and the result
+func (l *GCRALimiter) decide(tat, now int64) (int64, GCRAResult) {
+	result := GCRAResult{Limit: l.burst + 1}
+	if tat < now {
+		tat = now
+	}
+	allowAt := tat - l.interval*int64(l.burst)
+	if now < allowAt {
+		result.RetryAfter = time.Duration(allowAt-now) * time.Microsecond
+		result.ResetAfter = time.Duration(tat-now) * time.Microsecond
+		return tat, result
+	}
+	tat += l.interval
+	result.Allowed = true
+	result.Remaining = int((now - allowAt) / l.interval)
+	result.ResetAfter = time.Duration(tat-now) * time.Microsecond
+	return tat, result
+}
+
+/*
+GCRAKeyfunc returns the key to throttle a request on.  An empty key means the request isn't
+throttled
+*/
+type GCRAKeyfunc func(c *web.C, r *http.Request) string
+
+/*
+BuildGCRAMiddleWare creates throttling middleware using limiter.  Sets the same X-RateLimit-*
+headers as BuildThrottleMiddleWare, and a Retry-After header when a request is refused.  The
+Namespace and failure options in opts apply.  Algorithm does not.
+
+Assumes redis connection is in c.Env["redis"] - see BuildRedis()
+
+Example
+
+	limiter, err := redis.NewGCRALimiter(100, time.Minute, 20)
+	...
+	m.Use(redis.BuildGCRAMiddleWare(limiter, func(c *web.C, r *http.Request) string {
+		return fmt.Sprintf("api:gcra:%d", c.Env["service_id"].(int))
+	}, redis.ThrottleOptions{OnFailure: redis.FAIL_LOCAL}))
+*/
+func BuildGCRAMiddleWare(limiter *GCRALimiter, keyfunc GCRAKeyfunc, opts ThrottleOptions) func(c *web.C, h http.Handler) http.Handler {
+	onError := opts.OnError
+	if onError == nil {
+		onError = logThrottleError
+	}
+	breaker := newBreaker(opts.BreakerThreshold, opts.BreakerCooldown)
+	local := newLocalGCRA(limiter)
+
+	allow := func(c *web.C, key string) (GCRAResult, error) {
+		if !breaker.allow() {
+			return GCRAResult{}, ErrorCircuitOpen
+		}
+		redis_conn, ok := c.Env["redis"].(redigo.Conn)
+		if !ok {
+			breaker.done(ErrorNoRedisConn)
+			return GCRAResult{}, ErrorNoRedisConn
+		}
+		result, err := limiter.Allow(redis_conn, key)
+		breaker.done(breakerError(redis_conn, err))
+		return result, err
+	}
+
+	return func(c *web.C, h http.Handler) http.Handler {
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			key := keyfunc(c, r)
+			if key != "" {
+				key = NamespacedKey(opts.Namespace, key)
+				result, err := allow(c, key)
+				if err != nil {
+					onError(c, r, err)
+					switch opts.OnFailure {
+					case FAIL_OPEN:
+						h.ServeHTTP(w, r)
+						return
+					case FAIL_LOCAL:
+						result = local.allow(key)
+					default:
+						http.Error(w, fmt.Sprintf("Throttling: Cache failure, %v", err), http.StatusServiceUnavailable)
+						return
+					}
+				}
+
+				hdr := w.Header()
+				setHeaderInt(hdr, "X-RateLimit-Limit", result.Limit)
+				setHeaderInt(hdr, "X-RateLimit-Remaining", result.Remaining)
+				setHeaderInt64(hdr, "X-Ratelimit-Reset", time.Now().Add(result.ResetAfter).Unix())
+				if !result.Allowed {
+					setHeaderInt64(hdr, "Retry-After", ceilSeconds(result.RetryAfter))
+					http.Error(w, fmt.Sprintf("Request rate limit exceeded - allowed rate is %d requests every %v, with bursts of %d", limiter.rate, limiter.period, limiter.burst), 429)
+					return
+				}
+			}
+
+			h.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(handler)
+	}
+}
+
+// ceilSeconds rounds d up to whole seconds, so clients that wait that long will be allowed
+func ceilSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+/*
+localGCRA applies a GCRALimiter in memory, for when redis is unavailable
+*/
+type localGCRA struct {
+	limiter *GCRALimiter
+
+	mu        sync.Mutex
+	tats      map[string]int64
+	lastSweep int64
+}
+
+func newLocalGCRA(limiter *GCRALimiter) *localGCRA {
+	return &localGCRA{limiter: limiter, tats: map[string]int64{}}
+}
+
+func (l *localGCRA) allow(key string) GCRAResult {
+	now := time.Now().UnixNano() / int64(time.Microsecond)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget keys whose limiters have reset now and then, so keys that are no longer used don't
+	// build up
+	if now-l.lastSweep > int64(l.limiter.period/time.Microsecond) {
+		for k, tat := range l.tats {
+			if tat <= now {
+				delete(l.tats, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	tat, result := l.limiter.decide(l.tats[key], now)
+	l.tats[key] = tat
+	return result
+}
@@ -0,0 +1,167 @@
+package redis
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/zenazn/goji/web"
+)
+
+func TestNewGCRALimiter(t *testing.T) {
+	for _, bad := range []struct {
+		rate   int
+		period time.Duration
+		burst  int
+	}{
+		{0, time.Minute, 1},
+		{10, 0, 1},
+		{10, time.Minute, -1},
+		{10, time.Microsecond, 1},
+	} {
+		if _, err := NewGCRALimiter(bad.rate, bad.period, bad.burst); err != ErrorInvalidRate {
+			t.Fatalf("expected ErrorInvalidRate for %v, have %v", bad, err)
+		}
+	}
+
+	l, err := NewGCRALimiter(100, time.Minute, 20)
+	if err != nil {
+		t.Fatalf("failed to create limiter - %v", err)
+	}
+	if l.interval != 600000 {
+		t.Fatalf("expected a request every 600000us, have %d", l.interval)
+	}
+}
+
+func TestGCRADecide(t *testing.T) {
+	l, _ := NewGCRALimiter(10, time.Second, 2)
+	now := int64(1000000000)
+
+	// A burst of 3 is allowed at once, then requests are refused until the first cell is free
+	var tat int64
+	var result GCRAResult
+	for i := 0; i < 3; i++ {
+		tat, result = l.decide(tat, now)
+		if !result.Allowed || result.Remaining != 2-i || result.Limit != 3 {
+			t.Fatalf("request %d: unexpected result %#v", i, result)
+		}
+	}
+	if result.ResetAfter != 300*time.Millisecond {
+		t.Fatalf("expected reset in 300ms, have %v", result.ResetAfter)
+	}
+
+	tat, result = l.decide(tat, now+40000)
+	if result.Allowed || result.RetryAfter != 60*time.Millisecond || result.ResetAfter != 260*time.Millisecond {
+		t.Fatalf("unexpected result %#v", result)
+	}
+
+	// After waiting as long as we're told, one more request is allowed
+	tat, result = l.decide(tat, now+100000)
+	if !result.Allowed || result.Remaining != 0 {
+		t.Fatalf("unexpected result %#v", result)
+	}
+
+	// Long after, the full burst is available again
+	_, result = l.decide(tat, now+10000000)
+	if !result.Allowed || result.Remaining != 2 {
+		t.Fatalf("unexpected result %#v", result)
+	}
+}
+
+func TestGCRALimiter(t *testing.T) {
+	conn, err := redigo.Dial("tcp", ":6379")
+	if err != nil {
+		t.Skipf("Cannot connect to redis. %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Do("DEL", "testgcra:cheese"); err != nil {
+		t.Fatalf("failed to clear key - %v", err)
+	}
+
+	l, _ := NewGCRALimiter(1, time.Minute, 2)
+	for i := 0; i < 3; i++ {
+		result, err := l.Allow(conn, "testgcra:cheese")
+		if err != nil {
+			t.Fatalf("failed to check limit - %v", err)
+		}
+		if !result.Allowed || result.Remaining != 2-i {
+			t.Fatalf("request %d: unexpected result %#v", i, result)
+		}
+	}
+
+	result, err := l.Allow(conn, "testgcra:cheese")
+	if err != nil {
+		t.Fatalf("failed to check limit - %v", err)
+	}
+	if result.Allowed || result.RetryAfter <= 59*time.Second || result.RetryAfter > time.Minute {
+		t.Fatalf("unexpected result %#v", result)
+	}
+
+	// A single timestamp is stored, expiring when the limiter resets
+	if ttl, err := redigo.Int(conn.Do("PTTL", "testgcra:cheese")); err != nil || ttl <= 0 || ttl > 180000 {
+		t.Fatalf("unexpected TTL %d, %v", ttl, err)
+	}
+}
+
+func TestGCRAMiddleware(t *testing.T) {
+	f := startFakeRedis(t, func(args []string) string {
+		return "-ERR the cheese shop is closed\r\n"
+	})
+	defer f.Close()
+	conn, err := redigo.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect - %v", err)
+	}
+	defer conn.Close()
+
+	l, _ := NewGCRALimiter(1, time.Minute, 1)
+	var errs int
+	m := BuildGCRAMiddleWare(l, func(c *web.C, r *http.Request) string {
+		return r.URL.Path
+	}, ThrottleOptions{
+		Namespace: "cheeseshop",
+		OnFailure: FAIL_LOCAL,
+		OnError: func(c *web.C, r *http.Request, err error) {
+			errs++
+		},
+	})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	c := &web.C{Env: map[interface{}]interface{}{"redis": conn}}
+
+	request := func(path string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+		w := httptest.NewRecorder()
+		m(c, h).ServeHTTP(w, r)
+		return w
+	}
+
+	for i, expCode := range []int{200, 200, 429} {
+		w := request("/brie")
+		if w.Code != expCode {
+			t.Fatalf("request %d: expected %d, have %d", i, expCode, w.Code)
+		}
+		if limit := getHeaderInt(w.HeaderMap, "X-RateLimit-Limit"); limit != 2 {
+			t.Fatalf("X-RateLimit-Limit expected 2 was %d", limit)
+		}
+	}
+	w := request("/brie")
+	if retry := getHeaderInt(w.HeaderMap, "Retry-After"); retry < 59 || retry > 60 {
+		t.Fatalf("unexpected Retry-After %d", retry)
+	}
+	if w := request("/edam"); w.Code != 200 {
+		t.Fatalf("other keys should not be limited, have %d", w.Code)
+	}
+	if errs != 5 {
+		t.Fatalf("expected 5 errors, have %d", errs)
+	}
+
+	// The key is namespaced
+	commands := f.received()
+	if len(commands) == 0 || commands[0][len(commands[0])-3] != "cheeseshop:/brie" {
+		t.Fatalf("unexpected commands %v", commands)
+	}
+}
@@ -0,0 +1,265 @@
+package redis
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/philpearl/tt_goji_middleware/base"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	// Prefix of hash fields holding session values.  Other fields hold session metadata
+	HASH_VALUE_PREFIX = "v:"
+
+	hashCreated   = "created"
+	hashUserId    = "user_id"
+	hashUserAgent = "user_agent"
+	hashVersion   = "version"
+)
+
+/*
+hashSaveScript writes fields of a session hash and sets its TTL.
+
+KEYS[1] is the session key.  ARGV[1] is 1 to replace the whole session, or 0 to update the
+fields of a session that must already exist.  ARGV[2] is the TTL in seconds, or 0 for none.
+ARGV[3] is the version the stored session must have if it exists, or -1 to skip the check.
+ARGV[4] is the number of field/value pairs that follow.  Any remaining arguments are fields to
+delete.
+
+Returns the new version of the session.  Returns 0 if the session should exist but doesn't,
+which happens if it was destroyed or expired while the request was being handled.  Saving it
+would bring it back.  Sessions that are updated, or replaced with a version above 0, must exist.
+Returns -1 if the stored session has a different version.
+*/
+var hashSaveScript = redigo.NewScript(1, `
+local exists = redis.call('EXISTS', KEYS[1]) == 1
+if not exists and (ARGV[1] == '0' or tonumber(ARGV[3]) > 0) then
+	return 0
+end
+local version = tonumber(redis.call('HGET', KEYS[1], 'version') or '0')
+if exists and ARGV[3] ~= '-1' and version ~= tonumber(ARGV[3]) then
+	return -1
+end
+if ARGV[1] == '1' then
+	redis.call('DEL', KEYS[1])
+end
+local n = tonumber(ARGV[4])
+if n > 0 then
+	redis.call('HMSET', KEYS[1], unpack(ARGV, 5, 4 + 2 * n))
+end
+if #ARGV > 4 + 2 * n then
+	redis.call('HDEL', KEYS[1], unpack(ARGV, 5 + 2 * n))
+end
+redis.call('HSET', KEYS[1], 'version', version + 1)
+local ttl = tonumber(ARGV[2])
+if ttl > 0 then
+	redis.call('EXPIRE', KEYS[1], ttl)
+else
+	redis.call('PERSIST', KEYS[1])
+end
+return version + 1
+`)
+
+/*
+HashSessionHolder is a redis-backed session store that keeps each session in a hash, with a field
+for each session value.
+
+When a session that was loaded from redis is saved, only the values Put or Del'd during the
+request are written.  This means concurrent requests that change different values of the same
+session don't lose each other's changes.  Values changed in place, without calling Put, are not
+saved, and sessions marked dirty with SetDirty are rewritten in full.  Rewriting a session in
+full fails with base.ErrorSessionConflict if another request has saved it since it was loaded.
+
+Each value is encoded separately with Codec, which must implement base.ValueCodec.
+
+It requires a redigo redis connection set up in c.Env["redis"].  You can use
+BuildRedis() to create middleware that does this
+*/
+type HashSessionHolder struct {
+	base.BaseSessionHolder
+	Codec base.Codec
+	// Cluster, if set, hash-tags keys for use with Redis Cluster, when c.Env["redis"] is a Redis
+	// Cluster connection.  The whole session Id is the hash tag, and each session is a single
+	// key, so its commands are always in one slot.  Changing this loses existing sessions
+	Cluster bool
+	// Namespace, if set, prefixes all the keys.  See NamespacedKey
+	Namespace string
+}
+
+/*
+NewHashSessionHolder creates a new redis-backed session holder that stores sessions in hashes,
+encoding values with codec
+*/
+func NewHashSessionHolder(codec base.Codec) base.SessionHolder {
+	return &HashSessionHolder{
+		BaseSessionHolder: base.NewBaseSessionHolder(DEFAULT_SESSION_TIMEOUT),
+		Codec:             codec,
+	}
+}
+
+/*
+Get the session for this request from Redis
+*/
+func (sh *HashSessionHolder) Get(c web.C, r *http.Request) (*base.Session, error) {
+	sessionId := sh.GetSessionId(r)
+	if sessionId == "" {
+		return nil, base.ErrorSessionNotFound
+	}
+
+	conn := c.Env["redis"].(redigo.Conn)
+	conn.Send("MULTI")
+	conn.Send("HGETALL", sh.hashSessionKey(sessionId))
+	conn.Send("PTTL", sh.hashSessionKey(sessionId))
+	rsp, err := redigo.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	fields, err := redigo.StringMap(rsp[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, base.ErrorSessionNotFound
+	}
+	pttl, err := redigo.Int64(rsp[1], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	session := base.Session{Values: make(map[string]interface{}, len(fields))}
+	for field, data := range fields {
+		switch {
+		case strings.HasPrefix(field, HASH_VALUE_PREFIX):
+			value, err := base.DecodeValue([]byte(data))
+			if err != nil {
+				return nil, err
+			}
+			session.Values[field[len(HASH_VALUE_PREFIX):]] = value
+		case field == hashCreated:
+			if err := session.Created.UnmarshalText([]byte(data)); err != nil {
+				return nil, err
+			}
+		case field == hashUserId:
+			session.UserId = data
+		case field == hashUserAgent:
+			session.UserAgent = data
+		case field == hashVersion:
+			if session.Version, err = strconv.ParseInt(data, 10, 64); err != nil {
+				return nil, err
+			}
+		}
+	}
+	session.SetId(sessionId)
+
+	return &session, checkExpiry(&sh.BaseSessionHolder, &session, pttl)
+}
+
+/*
+Destroy deletes a session from redis
+*/
+func (sh *HashSessionHolder) Destroy(c web.C, session *base.Session) error {
+	delete(c.Env, "session")
+	conn := c.Env["redis"].(redigo.Conn)
+	_, err := conn.Do("DEL", sh.hashSessionKey(session.Id()))
+	return err
+}
+
+/*
+Save a session to redis, writing only the values that have changed if possible.  Returns
+base.ErrorSessionNotFound if the session has been destroyed or has expired since it was loaded, and
+base.ErrorSessionConflict if it is saved whole and has been saved elsewhere since it was loaded
+*/
+func (sh *HashSessionHolder) Save(c web.C, session *base.Session) error {
+	conn := c.Env["redis"].(redigo.Conn)
+	session.LastAccess = time.Now()
+
+	changes, partial := session.Changes()
+	// Partial saves can't lose other requests' changes, so don't need a version check
+	whole, expected := 0, int64(-1)
+	if !partial {
+		whole, expected = 1, session.Version
+		changes = make(map[string]bool, len(session.Values))
+		for key := range session.Values {
+			changes[key] = true
+		}
+	}
+
+	created, err := session.Created.MarshalText()
+	if err != nil {
+		return err
+	}
+	sets := []interface{}{hashCreated, created, hashUserId, session.UserId, hashUserAgent, session.UserAgent}
+	var dels []interface{}
+	for key, put := range changes {
+		field := HASH_VALUE_PREFIX + key
+		value, ok := session.Values[key]
+		if !put || !ok {
+			dels = append(dels, field)
+			continue
+		}
+		data, err := base.EncodeValue(sh.codec(), value)
+		if err != nil {
+			return err
+		}
+		sets = append(sets, field, data)
+	}
+
+	args := []interface{}{sh.hashSessionKey(session.Id()), whole, sh.StoreTTL(session, session.LastAccess), expected, len(sets) / 2}
+	args = append(args, sets...)
+	args = append(args, dels...)
+	version, err := redigo.Int64(hashSaveScript.Do(conn, args...))
+	switch {
+	case err != nil:
+		return err
+	case version == 0:
+		return base.ErrorSessionNotFound
+	case version < 0:
+		return base.ErrorSessionConflict
+	}
+	session.Version = version
+	return nil
+}
+
+func (sh *HashSessionHolder) RegenerateId(c web.C, session *base.Session) (string, error) {
+	newSessionId := sh.GenerateSessionId()
+	conn := c.Env["redis"].(redigo.Conn)
+	if err := renameKey(conn, sh.Cluster, sh.hashSessionKey(session.Id()), sh.hashSessionKey(newSessionId)); err != nil {
+		return session.Id(), err
+	}
+	session.SetId(newSessionId)
+	return newSessionId, nil
+}
+
+func (sh *HashSessionHolder) ResetTTL(c web.C, session *base.Session) error {
+	conn := c.Env["redis"].(redigo.Conn)
+	session.LastAccess = time.Now()
+
+	var err error
+	if ttl := sh.StoreTTL(session, session.LastAccess); ttl > 0 {
+		_, err = conn.Do("EXPIRE", sh.hashSessionKey(session.Id()), ttl)
+	} else {
+		_, err = conn.Do("PERSIST", sh.hashSessionKey(session.Id()))
+	}
+	return err
+}
+
+func (sh *HashSessionHolder) codec() base.Codec {
+	if sh.Codec == nil {
+		return base.GobCodec
+	}
+	return sh.Codec
+}
+
+// hashSessionKey is different to sessionKey so hashes never clash with sessions stored by SessionHolder
+func (sh *HashSessionHolder) hashSessionKey(sessionId string) string {
+	if sh.Cluster {
+		sessionId = HashTag(sessionId)
+	}
+	return NamespacedKey(sh.Namespace, fmt.Sprintf("hsess:%s", sessionId))
+}
@@ -0,0 +1,79 @@
+package redis
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/philpearl/tt_goji_middleware/base"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/zenazn/goji/web"
+)
+
+func TestHashSessionConcurrentChanges(t *testing.T) {
+	conn, err := redigo.Dial("tcp", ":6379")
+	if err != nil {
+		t.Skipf("Cannot connect to redis. %v", err)
+	}
+	c := web.C{
+		Env: map[interface{}]interface{}{"redis": conn},
+	}
+	sh := NewHashSessionHolder(base.BinaryCodec)
+
+	s := sh.Create(c)
+	s.Put("cheese", "cheddar")
+	s.Put("hat", "bowler")
+	if err := sh.Save(c, s); err != nil {
+		t.Fatalf("failed to save session - %v", err)
+	}
+	defer sh.Destroy(c, s)
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sessionid", Value: s.Id()})
+
+	// Two requests load the session and change different values
+	s1, err := sh.Get(c, r)
+	if err != nil {
+		t.Fatalf("got error reading session, %v", err)
+	}
+	s2, err := sh.Get(c, r)
+	if err != nil {
+		t.Fatalf("got error reading session, %v", err)
+	}
+	s1.Put("cheese", "brie")
+	s2.Del("hat")
+	s2.Put("coat", "mac")
+	if err := sh.Save(c, s1); err != nil {
+		t.Fatalf("failed to save session - %v", err)
+	}
+	if err := sh.Save(c, s2); err != nil {
+		t.Fatalf("failed to save session - %v", err)
+	}
+
+	s3, err := sh.Get(c, r)
+	if err != nil {
+		t.Fatalf("got error reading session, %v", err)
+	}
+	if cheese, _ := s3.Get("cheese"); cheese != "brie" {
+		t.Fatalf("cheese is %v", cheese)
+	}
+	if coat, _ := s3.Get("coat"); coat != "mac" {
+		t.Fatalf("coat is %v", coat)
+	}
+	if _, ok := s3.Get("hat"); ok {
+		t.Fatalf("hat should be deleted")
+	}
+	if s3.Created.Unix() != s.Created.Unix() {
+		t.Fatalf("created time is %v, expected %v", s3.Created, s.Created)
+	}
+
+	// Saving changes to a destroyed session doesn't bring it back
+	s3.Put("cheese", "edam")
+	sh.Destroy(c, s)
+	if err := sh.Save(c, s3); err != base.ErrorSessionNotFound {
+		t.Fatalf("expected ErrorSessionNotFound saving destroyed session, have %v", err)
+	}
+	if _, err := sh.Get(c, r); err != base.ErrorSessionNotFound {
+		t.Fatalf("session should stay destroyed, have %v", err)
+	}
+}
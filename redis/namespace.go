@@ -0,0 +1,135 @@
+package redis
+
+import (
+	"errors"
+	"strings"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const (
+	// Separates a namespace from the rest of a key
+	NAMESPACE_SEPARATOR = ":"
+
+	// How many keys to ask SCAN for each time
+	SCAN_COUNT = 1000
+)
+
+var (
+	ErrorEmptyNamespace error = errors.New("refusing to purge the empty namespace")
+	ErrorUnexpectedScan error = errors.New("unexpected SCAN reply")
+)
+
+/*
+NamespacedKey puts key in namespace.  Middleware in this package that stores data in redis has a
+Namespace option, applied with this function, so several applications can share a redis server
+without their keys colliding.  An empty namespace leaves the key unchanged.
+
+The separator, braces and % are escaped in the namespace, so one namespace is never the start of
+another, such as "app" of "app:admin", and a namespace doesn't change which cluster slot keys are
+in.
+*/
+func NamespacedKey(namespace, key string) string {
+	if namespace == "" {
+		return key
+	}
+	return namespaceEscaper.Replace(namespace) + NAMESPACE_SEPARATOR + key
+}
+
+// namespaceEscaper percent-encodes the characters in a namespace that could be confused with
+// the rest of the key
+var namespaceEscaper = strings.NewReplacer(`%`, `%25`, NAMESPACE_SEPARATOR, `%3A`, `{`, `%7B`, `}`, `%7D`)
+
+/*
+ScanNamespace calls fn with each key in namespace, using SCAN so redis isn't blocked.  Keys
+added or removed during the scan may or may not be seen, and a key may be seen more than once.
+Stops and returns the error if fn returns one.
+
+In a Redis Cluster, call this with a connection to each master node, made with redigo.Dial
+rather than from a cluster pool.
+*/
+func ScanNamespace(conn redigo.Conn, namespace string, fn func(key string) error) error {
+	match := matchEscaper.Replace(NamespacedKey(namespace, "")) + "*"
+	cursor := "0"
+	for {
+		rsp, err := redigo.Values(conn.Do("SCAN", cursor, "MATCH", match, "COUNT", SCAN_COUNT))
+		if err != nil {
+			return err
+		}
+		if len(rsp) != 2 {
+			return ErrorUnexpectedScan
+		}
+		if cursor, err = redigo.String(rsp[0], nil); err != nil {
+			return err
+		}
+		keys, err := redigo.Strings(rsp[1], nil)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+/*
+PurgeNamespace deletes all the keys in namespace and returns how many were deleted.  An empty
+namespace is refused, rather than deleting everything.  See ScanNamespace for using it with Redis
+Cluster
+*/
+func PurgeNamespace(conn redigo.Conn, namespace string) (int, error) {
+	if namespace == "" {
+		return 0, ErrorEmptyNamespace
+	}
+
+	var keys []string
+	var deleted int
+	purge := func() error {
+		n, err := deleteKeys(conn, keys)
+		deleted += n
+		keys = keys[:0]
+		return err
+	}
+	err := ScanNamespace(conn, namespace, func(key string) error {
+		keys = append(keys, key)
+		if len(keys) < SCAN_COUNT {
+			return nil
+		}
+		return purge()
+	})
+	if err == nil {
+		err = purge()
+	}
+	return deleted, err
+}
+
+// deleteKeys deletes keys one at a time, so it works when they are in different cluster slots.
+// The commands are pipelined
+func deleteKeys(conn redigo.Conn, keys []string) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	for _, key := range keys {
+		conn.Send("DEL", key)
+	}
+	if err := conn.Flush(); err != nil {
+		return 0, err
+	}
+	var deleted int
+	for range keys {
+		n, err := redigo.Int(conn.Receive())
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// matchEscaper escapes the characters SCAN MATCH treats as a pattern
+var matchEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
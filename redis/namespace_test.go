@@ -0,0 +1,140 @@
+package redis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+func TestNamespacedKey(t *testing.T) {
+	if key := NamespacedKey("", "sess:abc"); key != "sess:abc" {
+		t.Fatalf("key is %s", key)
+	}
+	if key := NamespacedKey("cheeseshop", "sess:abc"); key != "cheeseshop:sess:abc" {
+		t.Fatalf("key is %s", key)
+	}
+	sh := &SessionHolder{Namespace: "cheeseshop", Cluster: true}
+	if key := sh.sessionKey("abc"); key != "cheeseshop:sess:{abc}" {
+		t.Fatalf("key is %s", key)
+	}
+}
+
+func TestPurgeNamespace(t *testing.T) {
+	var mu sync.Mutex
+	keys := map[string]bool{"cheese*shop:a": true, "cheese*shop:b": true, "cheese*shop:c": true, "other:a": true}
+	var match string
+
+	// SCAN returns the matching keys a page at a time
+	f := startFakeRedis(t, func(args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch args[0] {
+		case "SCAN":
+			match = args[3]
+			var page []string
+			for key := range keys {
+				if strings.HasPrefix(key, "cheese*shop:") {
+					page = append(page, key)
+				}
+			}
+			sort.Strings(page)
+			cursor := "0"
+			if len(page) > 2 {
+				page, cursor = page[:2], "2"
+			}
+			reply := fmt.Sprintf("*2\r\n$%d\r\n%s\r\n*%d\r\n", len(cursor), cursor, len(page))
+			for _, key := range page {
+				reply += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+			}
+			return reply
+		case "DEL":
+			if keys[args[1]] {
+				delete(keys, args[1])
+				return ":1\r\n"
+			}
+			return ":0\r\n"
+		}
+		return "-ERR unexpected command\r\n"
+	})
+	defer f.Close()
+
+	conn, err := redigo.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect - %v", err)
+	}
+	defer conn.Close()
+
+	deleted, err := PurgeNamespace(conn, "cheese*shop")
+	if err != nil {
+		t.Fatalf("failed to purge - %v", err)
+	}
+	if deleted != 3 {
+		t.Fatalf("expected 3 keys deleted, have %d", deleted)
+	}
+	if match != `cheese\*shop:*` {
+		t.Fatalf("pattern not escaped, %s", match)
+	}
+	if len(keys) != 1 || !keys["other:a"] {
+		t.Fatalf("wrong keys deleted, %v remain", keys)
+	}
+
+	if _, err := PurgeNamespace(conn, ""); err != ErrorEmptyNamespace {
+		t.Fatalf("expected ErrorEmptyNamespace, have %v", err)
+	}
+}
+
+func TestNestedNamespaces(t *testing.T) {
+	if key := NamespacedKey("app:admin", "sess:abc"); key != "app%3Aadmin:sess:abc" {
+		t.Fatalf("key is %s", key)
+	}
+	if strings.HasPrefix(NamespacedKey("app:admin", "x"), NamespacedKey("app", "")) {
+		t.Fatalf("namespace app:admin is inside namespace app")
+	}
+	if KeySlot(NamespacedKey("{cheese}", "sess:{abc}")) != KeySlot("{abc}") {
+		t.Fatalf("namespace changes the key's hash tag")
+	}
+
+	// Purging one namespace leaves the other alone
+	var mu sync.Mutex
+	keys := map[string]bool{NamespacedKey("app", "a"): true, NamespacedKey("app:admin", "a"): true}
+	f := startFakeRedis(t, func(args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch args[0] {
+		case "SCAN":
+			prefix := strings.TrimSuffix(strings.Replace(args[3], `\`, "", -1), "*")
+			var page []string
+			for key := range keys {
+				if strings.HasPrefix(key, prefix) {
+					page = append(page, key)
+				}
+			}
+			reply := fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n", len(page))
+			for _, key := range page {
+				reply += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+			}
+			return reply
+		case "DEL":
+			delete(keys, args[1])
+			return ":1\r\n"
+		}
+		return "-ERR unexpected command\r\n"
+	})
+	defer f.Close()
+	conn, err := redigo.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect - %v", err)
+	}
+	defer conn.Close()
+
+	if deleted, err := PurgeNamespace(conn, "app"); err != nil || deleted != 1 {
+		t.Fatalf("expected 1 key deleted, have %d, %v", deleted, err)
+	}
+	if !keys[NamespacedKey("app:admin", "a")] {
+		t.Fatalf("nested namespace was purged")
+	}
+}
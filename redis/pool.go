@@ -0,0 +1,171 @@
+package redis
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const (
+	DEFAULT_REDIS_ADDR         = ":6379"
+	DEFAULT_REDIS_MAX_IDLE     = 3
+	DEFAULT_REDIS_IDLE_TIMEOUT = 240 * time.Second
+	// Timeout for connecting to, reading from and writing to Sentinels, unless ConnectTimeout,
+	// ReadTimeout or WriteTimeout is set
+	DEFAULT_SENTINEL_TIMEOUT = time.Second
+)
+
+var (
+	ErrorInvalidRedisURL error = errors.New("redis URL must start redis:// or rediss://")
+)
+
+/*
+RedisOptions controls how connections to redis are made and pooled
+*/
+type RedisOptions struct {
+	// Address of the redis server as host:port.  Defaults to DEFAULT_REDIS_ADDR
+	Addr string
+	// URL of the redis server, such as redis://:password@host:6379/2.  A rediss:// URL connects with
+	// TLS.  The password and database in the URL override Password and DB.  Addr is ignored if
+	// URL is set
+	URL string
+	// Password to AUTH with, if any
+	Password string
+	// Database to SELECT, if not 0
+	DB int
+
+	// SentinelAddrs, if set, are the host:port addresses of Redis Sentinels to ask for the address
+	// of the master called MasterName.  Addr and URL are ignored.  The master is found again
+	// if a connection to it fails, or it reports that it has become a read-only replica.  The
+	// command that saw the error still fails, but connections made afterwards go to the new
+	// master
+	SentinelAddrs []string
+	MasterName    string
+
+	// ClusterAddrs, if set, are host:port addresses of some of the nodes of a Redis Cluster.
+	// Connections from the pool send each command to the node that serves its key.  See
+	// KeySlot for how keys are assigned to nodes.  Addr, URL and the sentinel settings are
+	// ignored, and DB must be 0
+	ClusterAddrs []string
+
+	// TLS connects to the server using TLS.  TLSConfig, if set, configures it
+	TLS       bool
+	TLSConfig *tls.Config
+
+	// Timeouts for connecting, and for reading and writing each command.  0 means no timeout,
+	// except for connections to Sentinels, which default to DEFAULT_SENTINEL_TIMEOUT
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+
+	// Maximum idle connections kept in the pool.  Defaults to DEFAULT_REDIS_MAX_IDLE
+	MaxIdle int
+	// Maximum connections open at once.  0 means no limit
+	MaxActive int
+	// Close connections that have been idle this long.  Defaults to DEFAULT_REDIS_IDLE_TIMEOUT
+	IdleTimeout time.Duration
+	// Wait, if set, makes requests wait for a connection when MaxActive are in use, rather than
+	// failing
+	Wait bool
+	// TestOnBorrow checks idle connections before they are used.  See PingIdle
+	TestOnBorrow func(conn redigo.Conn, lastUsed time.Time) error
+}
+
+/*
+PingIdle returns a TestOnBorrow function that PINGs connections that have been idle for longer
+than idle, so connections dropped by the server or a firewall aren't handed to requests
+*/
+func PingIdle(idle time.Duration) func(conn redigo.Conn, lastUsed time.Time) error {
+	return func(conn redigo.Conn, lastUsed time.Time) error {
+		if time.Since(lastUsed) < idle {
+			return nil
+		}
+		_, err := conn.Do("PING")
+		return err
+	}
+}
+
+/*
+NewPool creates a redigo connection pool configured by opts.  Close the pool when you are done
+with it
+*/
+func NewPool(opts RedisOptions) (*redigo.Pool, error) {
+	var dial func() (redigo.Conn, error)
+	testOnBorrow := opts.TestOnBorrow
+	if len(opts.ClusterAddrs) > 0 {
+		dial = newCluster(&opts).dial
+	} else if len(opts.SentinelAddrs) > 0 {
+		s := newSentinel(&opts)
+		dial = s.dialer(opts.dialOptions())
+		testOnBorrow = s.testOnBorrow(testOnBorrow)
+	} else {
+		var err error
+		if dial, err = opts.dialer(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.MaxIdle == 0 {
+		opts.MaxIdle = DEFAULT_REDIS_MAX_IDLE
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = DEFAULT_REDIS_IDLE_TIMEOUT
+	}
+	return &redigo.Pool{
+		Dial:         dial,
+		TestOnBorrow: testOnBorrow,
+		MaxIdle:      opts.MaxIdle,
+		MaxActive:    opts.MaxActive,
+		IdleTimeout:  opts.IdleTimeout,
+		Wait:         opts.Wait,
+	}, nil
+}
+
+// dialOptions converts the connection settings to redigo dial options
+func (opts *RedisOptions) dialOptions() []redigo.DialOption {
+	options := []redigo.DialOption{
+		redigo.DialConnectTimeout(opts.ConnectTimeout),
+		redigo.DialReadTimeout(opts.ReadTimeout),
+		redigo.DialWriteTimeout(opts.WriteTimeout),
+		redigo.DialUseTLS(opts.TLS),
+	}
+	if opts.Password != "" {
+		options = append(options, redigo.DialPassword(opts.Password))
+	}
+	if opts.DB != 0 {
+		options = append(options, redigo.DialDatabase(opts.DB))
+	}
+	if opts.TLSConfig != nil {
+		options = append(options, redigo.DialTLSConfig(opts.TLSConfig))
+	}
+	return options
+}
+
+// dialer returns a function that opens a connection to the server
+func (opts *RedisOptions) dialer() (func() (redigo.Conn, error), error) {
+	options := opts.dialOptions()
+	if opts.URL != "" {
+		u, err := url.Parse(opts.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis URL. %v", err)
+		}
+		if u.Scheme != "redis" && u.Scheme != "rediss" {
+			return nil, ErrorInvalidRedisURL
+		}
+		rawurl := opts.URL
+		return func() (redigo.Conn, error) {
+			return redigo.DialURL(rawurl, options...)
+		}, nil
+	}
+
+	addr := opts.Addr
+	if addr == "" {
+		addr = DEFAULT_REDIS_ADDR
+	}
+	return func() (redigo.Conn, error) {
+		return redigo.Dial("tcp", addr, options...)
+	}, nil
+}
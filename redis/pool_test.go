@@ -0,0 +1,145 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/zenazn/goji/web"
+)
+
+// fakeRedis is a stand-in redis server for tests.  It records the commands it receives and
+// replies with whatever reply returns, which should be in the redis protocol
+type fakeRedis struct {
+	net.Listener
+	reply func(args []string) string
+
+	mu       sync.Mutex
+	commands [][]string
+}
+
+func startFakeRedis(t *testing.T, reply func(args []string) string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen - %v", err)
+	}
+	f := &fakeRedis{Listener: l, reply: reply}
+	go f.serve()
+	return f
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, args)
+		f.mu.Unlock()
+		if _, err := io.WriteString(conn, f.reply(args)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) received() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]string(nil), f.commands...)
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		l, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, l+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:l])
+	}
+	return args, nil
+}
+
+func okReply(args []string) string {
+	return "+OK\r\n"
+}
+
+func TestNewPool(t *testing.T) {
+	f := startFakeRedis(t, okReply)
+	defer f.Close()
+
+	for _, opts := range []RedisOptions{
+		{Addr: f.Addr().String(), Password: "cheese", DB: 3},
+		{URL: fmt.Sprintf("redis://:cheese@%s/3", f.Addr()), Password: "crackers", DB: 1},
+	} {
+		f.mu.Lock()
+		f.commands = nil
+		f.mu.Unlock()
+		opts.TestOnBorrow = PingIdle(time.Hour)
+		m, pool, err := BuildRedisWithOptions(opts)
+		if err != nil {
+			t.Fatalf("failed to build pool - %v", err)
+		}
+
+		var c web.C
+		c.Env = map[interface{}]interface{}{}
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c.Env["redis"].(redigo.Conn).Do("SET", "cheese", "stilton")
+		})
+		r, _ := http.NewRequest("GET", "/", nil)
+		m(&c, h).ServeHTTP(httptest.NewRecorder(), r)
+		m(&c, h).ServeHTTP(httptest.NewRecorder(), r)
+
+		// One connection is authenticated, selects the database and is reused
+		expected := [][]string{{"AUTH", "cheese"}, {"SELECT", "3"}, {"SET", "cheese", "stilton"}, {"SET", "cheese", "stilton"}}
+		if commands := f.received(); !reflect.DeepEqual(commands, expected) {
+			t.Fatalf("commands are %v", commands)
+		}
+		if err := pool.Close(); err != nil {
+			t.Fatalf("failed to close pool - %v", err)
+		}
+	}
+
+	if _, err := NewPool(RedisOptions{URL: "http://localhost:6379"}); err != ErrorInvalidRedisURL {
+		t.Fatalf("expected ErrorInvalidRedisURL, have %v", err)
+	}
+}
@@ -5,7 +5,6 @@ package redis
 
 import (
 	"net/http"
-	"time"
 
 	"github.com/zenazn/goji/web"
 
@@ -15,16 +14,38 @@ import (
 /*
 A middleware that ensures a redis connection is present in c.Env["redis"].  The
 connection is built from a redigo Pool.
+
+Use BuildRedisWithOptions to configure the connections, or to close the pool on shutdown.
 */
 func BuildRedis(redisAddr string) func(c *web.C, h http.Handler) http.Handler {
 	pool := &redigo.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
+		MaxIdle:     DEFAULT_REDIS_MAX_IDLE,
+		IdleTimeout: DEFAULT_REDIS_IDLE_TIMEOUT,
 		Dial: func() (redigo.Conn, error) {
 			return redigo.Dial("tcp", redisAddr)
 		},
 	}
+	return BuildRedisWithPool(pool)
+}
 
+/*
+BuildRedisWithOptions creates middleware that puts a connection to the redis server described by
+opts in c.Env["redis"].  It also returns the pool the connections come from, so you can use it
+outside HTTP requests and close it on shutdown.
+*/
+func BuildRedisWithOptions(opts RedisOptions) (func(c *web.C, h http.Handler) http.Handler, *redigo.Pool, error) {
+	pool, err := NewPool(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return BuildRedisWithPool(pool), pool, nil
+}
+
+/*
+BuildRedisWithPool creates middleware that puts a connection from an existing pool in
+c.Env["redis"]
+*/
+func BuildRedisWithPool(pool *redigo.Pool) func(c *web.C, h http.Handler) http.Handler {
 	return func(c *web.C, h http.Handler) http.Handler {
 		// Establish a connection to redis and store it in the environment
 		// Env["redis"].(redis.Conn)
@@ -0,0 +1,235 @@
+package redis
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+var (
+	ErrorNoRedisMaster  error = errors.New("no sentinel knows the redis master")
+	ErrorMasterChanged  error = errors.New("redis master has changed")
+	ErrorReadOnlyMaster error = errors.New("redis server is no longer the master")
+)
+
+/*
+sentinel finds the current redis master by asking a list of Sentinels.  The address is remembered
+until a connection to it fails, or the server says it is a read-only replica, which happens after
+a failover.  Connections made before then are closed rather than reused.
+*/
+type sentinel struct {
+	addrs      []string
+	masterName string
+	// Options for connections to the sentinels
+	options []redigo.DialOption
+
+	mu         sync.Mutex
+	master     string
+	generation int
+	// The lookup in progress, if any
+	lookup *sentinelLookup
+}
+
+// sentinelLookup is a search for the master that other connections can wait for
+type sentinelLookup struct {
+	done       chan struct{}
+	master     string
+	generation int
+	err        error
+}
+
+func newSentinel(opts *RedisOptions) *sentinel {
+	return &sentinel{
+		addrs:      append([]string(nil), opts.SentinelAddrs...),
+		masterName: opts.MasterName,
+		options: []redigo.DialOption{
+			redigo.DialConnectTimeout(sentinelTimeout(opts.ConnectTimeout)),
+			redigo.DialReadTimeout(sentinelTimeout(opts.ReadTimeout)),
+			redigo.DialWriteTimeout(sentinelTimeout(opts.WriteTimeout)),
+		},
+	}
+}
+
+func sentinelTimeout(timeout time.Duration) time.Duration {
+	if timeout == 0 {
+		return DEFAULT_SENTINEL_TIMEOUT
+	}
+	return timeout
+}
+
+// resolve returns the address of the master, and the generation of that address.  Only one
+// connection asks the sentinels at a time, and others wait for its answer.  The lock isn't held
+// while asking, so checking whether connections are current isn't held up by slow sentinels
+func (s *sentinel) resolve() (string, int, error) {
+	s.mu.Lock()
+	if s.master != "" {
+		defer s.mu.Unlock()
+		return s.master, s.generation, nil
+	}
+	if l := s.lookup; l != nil {
+		s.mu.Unlock()
+		<-l.done
+		return l.master, l.generation, l.err
+	}
+	l := &sentinelLookup{done: make(chan struct{}), generation: s.generation}
+	s.lookup = l
+	addrs := append([]string(nil), s.addrs...)
+	s.mu.Unlock()
+
+	var found string
+	l.err = ErrorNoRedisMaster
+	for _, addr := range addrs {
+		if l.master, l.err = s.ask(addr); l.err == nil {
+			found = addr
+			break
+		}
+	}
+
+	s.mu.Lock()
+	if l.err == nil && l.generation == s.generation {
+		s.master = l.master
+		// Ask the sentinel that answered first next time
+		for i, addr := range s.addrs {
+			if addr == found {
+				copy(s.addrs[1:i+1], s.addrs[:i])
+				s.addrs[0] = addr
+				break
+			}
+		}
+	}
+	s.lookup = nil
+	s.mu.Unlock()
+	close(l.done)
+	return l.master, l.generation, l.err
+}
+
+// ask asks one sentinel for the master's address
+func (s *sentinel) ask(addr string) (string, error) {
+	conn, err := redigo.Dial("tcp", addr, s.options...)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	hostPort, err := redigo.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.masterName))
+	if err == redigo.ErrNil {
+		return "", ErrorNoRedisMaster
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(hostPort) != 2 {
+		return "", ErrorNoRedisMaster
+	}
+	return net.JoinHostPort(hostPort[0], hostPort[1]), nil
+}
+
+// invalidate forgets the master address if it is still the one from generation, so the next
+// connection asks the sentinels again
+func (s *sentinel) invalidate(generation int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if generation == s.generation {
+		s.master = ""
+		s.generation++
+	}
+}
+
+func (s *sentinel) current(generation int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return generation == s.generation
+}
+
+// dialer returns a function that connects to the current master
+func (s *sentinel) dialer(options []redigo.DialOption) func() (redigo.Conn, error) {
+	return func() (redigo.Conn, error) {
+		addr, generation, err := s.resolve()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := redigo.Dial("tcp", addr, options...)
+		if err != nil {
+			s.invalidate(generation)
+			return nil, err
+		}
+		return &sentinelConn{Conn: conn, s: s, generation: generation}, nil
+	}
+}
+
+// testOnBorrow stops idle connections to an old master being reused, then calls test, if set
+func (s *sentinel) testOnBorrow(test func(redigo.Conn, time.Time) error) func(redigo.Conn, time.Time) error {
+	return func(conn redigo.Conn, lastUsed time.Time) error {
+		if err := conn.Err(); err != nil {
+			return err
+		}
+		if test != nil {
+			return test(conn, lastUsed)
+		}
+		return nil
+	}
+}
+
+// sentinelConn is a connection to a master found by a sentinel.  It watches for errors that
+// mean the master has changed
+type sentinelConn struct {
+	redigo.Conn
+	s          *sentinel
+	generation int
+	err        error
+}
+
+// Err reports an error if the connection is not to the current master, so the pool closes it
+func (c *sentinelConn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	if err := c.Conn.Err(); err != nil {
+		return err
+	}
+	if !c.s.current(c.generation) {
+		return ErrorMasterChanged
+	}
+	return nil
+}
+
+func (c *sentinelConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(commandName, args...)
+	c.check(err)
+	return reply, err
+}
+
+func (c *sentinelConn) Send(commandName string, args ...interface{}) error {
+	err := c.Conn.Send(commandName, args...)
+	c.check(err)
+	return err
+}
+
+func (c *sentinelConn) Flush() error {
+	err := c.Conn.Flush()
+	c.check(err)
+	return err
+}
+
+func (c *sentinelConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.check(err)
+	return reply, err
+}
+
+// check looks for errors that mean we are no longer talking to the master
+func (c *sentinelConn) check(err error) {
+	if err == nil {
+		return
+	}
+	// Scripts report the error within their own message, so look for it anywhere
+	if rerr, ok := err.(redigo.Error); ok && strings.Contains(string(rerr), "READONLY") {
+		c.err = ErrorReadOnlyMaster
+		c.s.invalidate(c.generation)
+	} else if c.Conn.Err() != nil {
+		c.s.invalidate(c.generation)
+	}
+}
@@ -0,0 +1,175 @@
+package redis
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/zenazn/goji/web"
+)
+
+func TestSentinelFailover(t *testing.T) {
+	var mu sync.Mutex
+	var master string
+	readOnly := map[string]bool{}
+
+	serverReply := func(addr *string) func(args []string) string {
+		return func(args []string) string {
+			mu.Lock()
+			defer mu.Unlock()
+			if readOnly[*addr] {
+				return "-READONLY You can't write against a read only replica.\r\n"
+			}
+			return "+OK\r\n"
+		}
+	}
+	var addr1, addr2 string
+	server1 := startFakeRedis(t, serverReply(&addr1))
+	defer server1.Close()
+	server2 := startFakeRedis(t, serverReply(&addr2))
+	defer server2.Close()
+	addr1, addr2 = server1.Addr().String(), server2.Addr().String()
+
+	sentinel := startFakeRedis(t, func(args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(args) != 3 || args[0] != "SENTINEL" || args[2] != "cheeseboard" {
+			return "-ERR unexpected command\r\n"
+		}
+		host, port, _ := net.SplitHostPort(master)
+		return fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+	})
+	defer sentinel.Close()
+	master = addr1
+
+	// The first sentinel isn't running
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := l.Addr().String()
+	l.Close()
+
+	m, pool, err := BuildRedisWithOptions(RedisOptions{
+		SentinelAddrs: []string{down, sentinel.Addr().String()},
+		MasterName:    "cheeseboard",
+	})
+	if err != nil {
+		t.Fatalf("failed to build pool - %v", err)
+	}
+	defer pool.Close()
+
+	var c web.C
+	var cmdErr error
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, cmdErr = c.Env["redis"].(redigo.Conn).Do("SET", "cheese", "stilton")
+	})
+	request := func() error {
+		c.Env = map[interface{}]interface{}{}
+		r, _ := http.NewRequest("GET", "/", nil)
+		m(&c, h).ServeHTTP(httptest.NewRecorder(), r)
+		return cmdErr
+	}
+
+	if err := request(); err != nil {
+		t.Fatalf("command failed - %v", err)
+	}
+	if n := len(server1.received()); n != 1 {
+		t.Fatalf("expected 1 command sent to the first master, have %d", n)
+	}
+
+	// Fail over.  The first command after sees the old master is now read-only
+	mu.Lock()
+	master = addr2
+	readOnly[addr1] = true
+	mu.Unlock()
+
+	if err := request(); err == nil {
+		t.Fatalf("expected READONLY error")
+	}
+	if err := request(); err != nil {
+		t.Fatalf("command failed after failover - %v", err)
+	}
+	if n := len(server2.received()); n != 1 {
+		t.Fatalf("expected 1 command sent to the new master, have %d", n)
+	}
+	if n := len(server1.received()); n != 2 {
+		t.Fatalf("expected no more commands sent to the old master, have %d", n)
+	}
+}
+
+func TestSentinelNoMaster(t *testing.T) {
+	sentinel := startFakeRedis(t, func(args []string) string {
+		return "*-1\r\n"
+	})
+	defer sentinel.Close()
+
+	pool, err := NewPool(RedisOptions{SentinelAddrs: []string{sentinel.Addr().String()}, MasterName: "cheeseboard"})
+	if err != nil {
+		t.Fatalf("failed to build pool - %v", err)
+	}
+	defer pool.Close()
+
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != ErrorNoRedisMaster {
+		t.Fatalf("expected ErrorNoRedisMaster, have %v", err)
+	}
+}
+
+func TestSentinelBlackhole(t *testing.T) {
+	// A sentinel that accepts connections but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen - %v", err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	s := newSentinel(&RedisOptions{SentinelAddrs: []string{l.Addr().String()}, MasterName: "cheeseboard"})
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, errs[i] = s.resolve()
+		}(i)
+	}
+	conn := <-accepted
+	defer conn.Close()
+
+	// Checking connections isn't held up while the sentinel is asked
+	checked := make(chan bool)
+	go func() { checked <- s.current(0) }()
+	select {
+	case <-checked:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("checking the generation waited for the sentinel")
+	}
+
+	wg.Wait()
+	for _, err := range errs {
+		if err == nil {
+			t.Fatalf("expected an error from the silent sentinel")
+		}
+	}
+	if elapsed := time.Since(start); elapsed > DEFAULT_SENTINEL_TIMEOUT+time.Second {
+		t.Fatalf("sentinel lookup took %v", elapsed)
+	}
+	if len(accepted) != 0 {
+		t.Fatalf("expected one lookup, have %d", len(accepted)+1)
+	}
+}
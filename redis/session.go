@@ -2,9 +2,15 @@ package redis
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/philpearl/tt_goji_middleware/base"
 
@@ -14,6 +20,8 @@ import (
 
 const (
 	DEFAULT_SESSION_TIMEOUT = 30 * 24 * 60 * 60
+	// In cluster mode, the length of the start of a session Id that is used as its hash tag
+	CLUSTER_TAG_LEN = 8
 )
 
 func init() {
@@ -22,26 +30,64 @@ func init() {
 }
 
 /*
-SessionHolder is a redis-backed session store that gob-encodes sessions.
+SessionHolder is a redis-backed session store.  Sessions are encoded with Codec, which is
+base.GobCodec unless you choose another with NewSessionHolderWithCodec.  Sessions written by any
+registered codec, or before codecs were introduced, can be read.
+
+Sessions are stored with a TTL matching their expiry time plus ExpiryGrace, so Redis removes them
+once they've expired.
+
+SessionHolder implements base.UserSessionIndex, keeping a set of session Ids for each user.
+
+To use Redis Cluster, set Cluster and get connections from a pool built with
+RedisOptions.ClusterAddrs.
 
 It requires a redigo redis connection set up in c.Env["redis"].  You can use
 BuildRedis() to create middleware that does this
 */
 type SessionHolder struct {
 	base.BaseSessionHolder
+	Codec base.Codec
+	// Cluster, if set, hash-tags keys and keeps each transaction within one cluster slot, for
+	// when c.Env["redis"] is a Redis Cluster connection.  The first CLUSTER_TAG_LEN characters
+	// of a session Id are its hash tag.  A session and its user's set are in different slots,
+	// so are updated in separate transactions, unless UserTagKey is set.  Changing this loses
+	// existing sessions
+	Cluster bool
+	// UserTagKey, if set in cluster mode, keeps a user's sessions in the same slot as their set
+	// so they are updated together.  BindUser gives the session a new Id starting with an HMAC
+	// of the user Id with this key, which is also the tag of the user's set.  Keep the key
+	// secret, as without it the tag doesn't say who the user is.  All a user's sessions do
+	// share the tag, though.  Use at least 32 random bytes.  Changing it loses the record of
+	// which sessions belong to each user.  It is ignored if the IdGenerator doesn't accept Ids
+	// with the tag in
+	UserTagKey []byte
+	// Namespace, if set, prefixes all the keys.  See NamespacedKey
+	Namespace string
 }
 
 /*
 NewSessionHolder creates a new redis-backed gob-encoded session holder
 */
 func NewSessionHolder() base.SessionHolder {
+	return NewSessionHolderWithCodec(base.GobCodec)
+}
+
+/*
+NewSessionHolderWithCodec creates a new redis-backed session holder that encodes sessions with codec
+*/
+func NewSessionHolderWithCodec(codec base.Codec) base.SessionHolder {
 	return &SessionHolder{
 		BaseSessionHolder: base.NewBaseSessionHolder(DEFAULT_SESSION_TIMEOUT),
+		Codec:             codec,
 	}
 }
 
 /*
 Get the session for this request from Redis
+
+Expired sessions are kept in Redis for ExpiryGrace seconds beyond their expiry time, so expiry is
+detected from the remaining TTL of the key.
 */
 func (sh *SessionHolder) Get(c web.C, r *http.Request) (*base.Session, error) {
 	sessionId := sh.GetSessionId(r)
@@ -50,27 +96,55 @@ func (sh *SessionHolder) Get(c web.C, r *http.Request) (*base.Session, error) {
 	}
 
 	conn := c.Env["redis"].(redigo.Conn)
+	return sh.load(conn, sessionId)
+}
 
-	sess, err := conn.Do("GET", sessionKey(sessionId))
+// load reads a session from redis, returning ErrorSessionExpired along with the session if it has expired
+func (sh *SessionHolder) load(conn redigo.Conn, sessionId string) (*base.Session, error) {
+	conn.Send("MULTI")
+	conn.Send("GET", sh.sessionKey(sessionId))
+	conn.Send("PTTL", sh.sessionKey(sessionId))
+	rsp, err := redigo.Values(conn.Do("EXEC"))
 	if err != nil {
 		return nil, err
 	}
-	if sess == nil {
+	if rsp[0] == nil {
 		return nil, base.ErrorSessionNotFound
 	}
-	sessionBytes, err := redigo.Bytes(sess, err)
+	sessionBytes, err := redigo.Bytes(rsp[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	pttl, err := redigo.Int64(rsp[1], nil)
 	if err != nil {
 		return nil, err
 	}
 
-	dec := gob.NewDecoder(bytes.NewReader(sessionBytes))
 	var session base.Session
-	err = dec.Decode(&session)
-	if err == nil {
-		session.SetId(sessionId)
+	err = base.DecodeSession(sessionBytes, &session)
+	if err == base.ErrorUnknownCodec {
+		// Stored before codecs were introduced, when the whole session was gob-encoded
+		err = gob.NewDecoder(bytes.NewReader(sessionBytes)).Decode(&session)
 	}
+	if err != nil {
+		return &session, err
+	}
+	session.SetId(sessionId)
+
+	return &session, checkExpiry(&sh.BaseSessionHolder, &session, pttl)
+}
 
-	return &session, err
+// checkExpiry works out when the session was last accessed from the remaining TTL of its key in
+// milliseconds, and checks whether it has expired
+func checkExpiry(sh *base.BaseSessionHolder, session *base.Session, pttl int64) error {
+	now := time.Now()
+	session.LastAccess = now
+	if pttl > 0 && sh.Timeout > 0 {
+		// The key expires ExpiryGrace after the session, which is Timeout after it was last accessed
+		expires := now.Add(time.Duration(pttl)*time.Millisecond - time.Duration(sh.ExpiryGrace)*time.Second)
+		session.LastAccess = expires.Add(-time.Duration(sh.Timeout) * time.Second)
+	}
+	return sh.CheckExpiry(session, now)
 }
 
 /*
@@ -81,53 +155,360 @@ func (sh *SessionHolder) Destroy(c web.C, session *base.Session) error {
 	delete(c.Env, "session")
 	conn := c.Env["redis"].(redigo.Conn)
 
-	_, err := conn.Do("DEL", sessionKey(sessionId))
+	if session.UserId == "" {
+		_, err := conn.Do("DEL", sh.sessionKey(sessionId))
+		return err
+	}
+
+	_, err := sh.exec(conn, []command{
+		{"DEL", []interface{}{sh.sessionKey(sessionId)}},
+		{"SREM", []interface{}{sh.userSessionsKey(session.UserId), sessionId}},
+	})
 	return err
 }
 
 /*
-Save a session to redis
+Save a session to redis.  Returns base.ErrorSessionConflict if the stored session has been saved
+since this one was loaded, and base.ErrorSessionNotFound if it has been destroyed or has expired
+since
 */
 func (sh *SessionHolder) Save(c web.C, session *base.Session) error {
 	sessionId := session.Id()
 	conn := c.Env["redis"].(redigo.Conn)
+	session.LastAccess = time.Now()
 
-	var b bytes.Buffer
-	enc := gob.NewEncoder(&b)
-
-	err := enc.Encode(session)
+	// WATCH makes the EXEC fail if another request saves the session after we check its version
+	if _, err := conn.Do("WATCH", sh.sessionKey(sessionId)); err != nil {
+		return err
+	}
+	version, err := sh.storedVersion(conn, sessionId)
+	if err == nil && version < 0 && session.Version > 0 {
+		err = base.ErrorSessionNotFound
+	} else if err == nil && version >= 0 && version != session.Version {
+		err = base.ErrorSessionConflict
+	}
 	if err != nil {
+		conn.Do("UNWATCH")
 		return err
 	}
 
-	_, err = conn.Do("SET", sessionKey(sessionId), b.String(), "EX", sh.Timeout)
+	session.Version++
+	data, err := base.EncodeSession(sh.codec(), session)
+	if err != nil {
+		session.Version--
+		conn.Do("UNWATCH")
+		return err
+	}
 
+	set := command{"SET", []interface{}{sh.sessionKey(sessionId), data}}
+	if ttl := sh.StoreTTL(session, session.LastAccess); ttl > 0 {
+		set.args = append(set.args, "EX", ttl)
+	}
+	cmds := []command{set}
+	if session.UserId != "" {
+		cmds = append(cmds,
+			command{"SADD", []interface{}{sh.userSessionsKey(session.UserId), sessionId}},
+			sh.userSessionsTTL(session.UserId),
+		)
+	}
+	rsp, err := sh.exec(conn, cmds)
+	if err == nil && rsp == nil {
+		// The watched key changed
+		err = base.ErrorSessionConflict
+	}
+	if err != nil {
+		session.Version--
+	}
 	return err
 }
 
+// storedVersion returns the version of the session as currently stored, or -1 if it isn't stored
+func (sh *SessionHolder) storedVersion(conn redigo.Conn, sessionId string) (int64, error) {
+	data, err := redigo.Bytes(conn.Do("GET", sh.sessionKey(sessionId)))
+	if err == redigo.ErrNil {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var session base.Session
+	err = base.DecodeSession(data, &session)
+	if err == base.ErrorUnknownCodec {
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&session)
+	}
+	return session.Version, err
+}
+
 func (sh *SessionHolder) RegenerateId(c web.C, session *base.Session) (string, error) {
-	sessionId    := session.Id()
-	newSessionId := sh.GenerateSessionId()
+	sessionId := session.Id()
+	// Keep a bound session in its user's slot
+	newSessionId, ok := sh.generateUserSessionId(session.UserId)
+	if !ok {
+		newSessionId = sh.GenerateSessionId()
+	}
 	conn := c.Env["redis"].(redigo.Conn)
-	_, err := conn.Do("RENAME", sessionKey(sessionId), sessionKey(newSessionId))
-	
-	if err == nil {
-		/* renaming of session key succeeded in backend... update sessionId in our struct */
-		session.SetId(newSessionId)
+	from, to := sh.sessionKey(sessionId), sh.sessionKey(newSessionId)
+
+	var err error
+	if session.UserId != "" && (!sh.Cluster || KeySlot(from) == KeySlot(to)) {
+		// Rename the session and update the user's set together
+		var rsp interface{}
+		rsp, err = sh.exec(conn, []command{
+			{"RENAME", []interface{}{from, to}},
+			{"SREM", []interface{}{sh.userSessionsKey(session.UserId), sessionId}},
+			{"SADD", []interface{}{sh.userSessionsKey(session.UserId), newSessionId}},
+		})
+		if replies, ok := rsp.([]interface{}); err == nil && ok && len(replies) > 0 {
+			if rerr, ok := replies[0].(redigo.Error); ok {
+				err = rerr
+			}
+		}
 	} else {
-		newSessionId = sessionId
+		err = renameKey(conn, sh.Cluster, from, to)
+		if err == nil && session.UserId != "" {
+			_, err = sh.exec(conn, []command{
+				{"SREM", []interface{}{sh.userSessionsKey(session.UserId), sessionId}},
+				{"SADD", []interface{}{sh.userSessionsKey(session.UserId), newSessionId}},
+			})
+		}
+	}
+
+	if err != nil {
+		return sessionId, err
 	}
-	return newSessionId, err
+	/* renaming of session key succeeded in backend... update sessionId in our struct */
+	session.SetId(newSessionId)
+	return newSessionId, nil
 }
 
 func (sh *SessionHolder) ResetTTL(c web.C, session *base.Session) error {
 	sessionId := session.Id()
 	conn := c.Env["redis"].(redigo.Conn)
-	_, err := conn.Do("EXPIRE", sessionKey(sessionId), sh.Timeout)
-	
+	session.LastAccess = time.Now()
+
+	cmds := []command{{"PERSIST", []interface{}{sh.sessionKey(sessionId)}}}
+	if ttl := sh.StoreTTL(session, session.LastAccess); ttl > 0 {
+		cmds[0] = command{"EXPIRE", []interface{}{sh.sessionKey(sessionId), ttl}}
+	}
+	if session.UserId != "" {
+		cmds = append(cmds, sh.userSessionsTTL(session.UserId))
+	}
+	_, err := sh.exec(conn, cmds)
+
 	return err
 }
 
-func sessionKey(sessionId string) string {
-	return fmt.Sprintf("sess:%s", sessionId)
+/*
+BindUser records that session belongs to userId, and saves it.  In cluster mode the session is
+given a new Id in the same slot as the user's set, unless it already has one
+*/
+func (sh *SessionHolder) BindUser(c web.C, r *http.Request, session *base.Session, userId string) error {
+	conn := c.Env["redis"].(redigo.Conn)
+	sessionId := session.Id()
+	newSessionId := sessionId
+	if !sh.inUserSlot(sessionId, userId) {
+		if id, ok := sh.generateUserSessionId(userId); ok {
+			newSessionId = id
+		}
+	}
+
+	if session.UserId != "" && (session.UserId != userId || newSessionId != sessionId) {
+		if _, err := conn.Do("SREM", sh.userSessionsKey(session.UserId), sessionId); err != nil {
+			return err
+		}
+	}
+	if newSessionId != sessionId {
+		if session.Version > 0 {
+			if err := renameKey(conn, sh.Cluster, sh.sessionKey(sessionId), sh.sessionKey(newSessionId)); err != nil {
+				return err
+			}
+		}
+		session.SetId(newSessionId)
+	}
+	session.SetUser(userId, r.UserAgent())
+	return sh.Save(c, session)
+}
+
+/*
+UserSessions lists the user's sessions that have not expired, most recently used first.  Sessions
+that have gone from redis are removed from the user's set as they are found
+*/
+func (sh *SessionHolder) UserSessions(c web.C, userId string) ([]base.SessionInfo, error) {
+	conn := c.Env["redis"].(redigo.Conn)
+	sessions, err := sh.userSessions(conn, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	infos := make([]base.SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		if sh.CheckExpiry(session, now) == nil {
+			infos = append(infos, session.Info())
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].LastAccess.After(infos[j].LastAccess) })
+	return infos, nil
+}
+
+/*
+DestroyUserSessions destroys all the user's sessions
+*/
+func (sh *SessionHolder) DestroyUserSessions(c web.C, userId string) error {
+	conn := c.Env["redis"].(redigo.Conn)
+	sessions, err := sh.userSessions(conn, userId)
+	if err != nil {
+		return err
+	}
+
+	cmds := make([]command, 0, len(sessions)+1)
+	for _, session := range sessions {
+		cmds = append(cmds, command{"DEL", []interface{}{sh.sessionKey(session.Id())}})
+	}
+	cmds = append(cmds, command{"DEL", []interface{}{sh.userSessionsKey(userId)}})
+	if _, err := sh.exec(conn, cmds); err != nil {
+		return err
+	}
+
+	if session, ok := base.SessionFromEnv(&c); ok && session.UserId == userId {
+		delete(c.Env, "session")
+	}
+	return nil
+}
+
+// userSessions loads the sessions in the user's set, including expired ones.  Ids of sessions that
+// no longer exist or now belong to another user are removed from the set
+func (sh *SessionHolder) userSessions(conn redigo.Conn, userId string) ([]*base.Session, error) {
+	sessionIds, err := redigo.Strings(conn.Do("SMEMBERS", sh.userSessionsKey(userId)))
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*base.Session
+	stale := []interface{}{sh.userSessionsKey(userId)}
+	for _, sessionId := range sessionIds {
+		session, err := sh.load(conn, sessionId)
+		switch err {
+		case nil, base.ErrorSessionExpired:
+			if session.UserId == userId {
+				sessions = append(sessions, session)
+			} else {
+				stale = append(stale, sessionId)
+			}
+		case base.ErrorSessionNotFound:
+			stale = append(stale, sessionId)
+		default:
+			return nil, err
+		}
+	}
+
+	if len(stale) > 1 {
+		if _, err := conn.Do("SREM", stale...); err != nil {
+			return nil, err
+		}
+	}
+	return sessions, nil
+}
+
+// userSessionsTTL is a command to keep the user's set at least as long as any session saved now
+func (sh *SessionHolder) userSessionsTTL(userId string) command {
+	now := time.Now()
+	if ttl := sh.StoreTTL(&base.Session{Created: now}, now); ttl > 0 {
+		return command{"EXPIRE", []interface{}{sh.userSessionsKey(userId), ttl}}
+	}
+	return command{"PERSIST", []interface{}{sh.userSessionsKey(userId)}}
+}
+
+// exec runs commands in a transaction and returns the reply to EXEC.  In cluster mode there is a
+// transaction for each slot, in order, and the reply is from the first.  If the first is aborted
+// by a WATCH the rest aren't run
+func (sh *SessionHolder) exec(conn redigo.Conn, cmds []command) (interface{}, error) {
+	groups := [][]command{cmds}
+	if sh.Cluster {
+		groups = groupBySlot(cmds)
+	}
+
+	var first interface{}
+	for i, group := range groups {
+		conn.Send("MULTI")
+		for _, cmd := range group {
+			conn.Send(cmd.name, cmd.args...)
+		}
+		rsp, err := conn.Do("EXEC")
+		if err != nil {
+			return first, err
+		}
+		if i == 0 {
+			if rsp == nil {
+				return nil, nil
+			}
+			first = rsp
+		}
+	}
+	return first, nil
+}
+
+func (sh *SessionHolder) codec() base.Codec {
+	if sh.Codec == nil {
+		return base.GobCodec
+	}
+	return sh.Codec
+}
+
+func (sh *SessionHolder) sessionKey(sessionId string) string {
+	if sh.Cluster {
+		if len(sessionId) > CLUSTER_TAG_LEN {
+			sessionId = HashTag(sessionId[:CLUSTER_TAG_LEN]) + sessionId[CLUSTER_TAG_LEN:]
+		} else {
+			sessionId = HashTag(sessionId)
+		}
+	}
+	return NamespacedKey(sh.Namespace, fmt.Sprintf("sess:%s", sessionId))
+}
+
+func (sh *SessionHolder) userSessionsKey(userId string) string {
+	if tag, ok := sh.userTag(userId); ok {
+		userId = HashTag(tag) + userId
+	} else if sh.Cluster {
+		userId = HashTag(userId)
+	}
+	return NamespacedKey(sh.Namespace, fmt.Sprintf("usersess:%s", userId))
+}
+
+// userTag is the cluster hash tag for the user's sessions, keyed with UserTagKey so that it
+// doesn't identify the user.  It is hex, so can replace the start of an Id made with either
+// base.IdEncoding.  Returns false if there is no tag to keep the user's sessions together
+func (sh *SessionHolder) userTag(userId string) (string, bool) {
+	if !sh.Cluster || len(sh.UserTagKey) == 0 || userId == "" {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, sh.UserTagKey)
+	mac.Write([]byte(userId))
+	return hex.EncodeToString(mac.Sum(nil)[:CLUSTER_TAG_LEN/2]), true
+}
+
+// generateUserSessionId generates a session Id starting with the user's tag, so the session is
+// in the same slot as the user's set.  Returns false if the user has no tag, or the IdGenerator
+// doesn't accept Ids with the tag in
+func (sh *SessionHolder) generateUserSessionId(userId string) (string, bool) {
+	tag, ok := sh.userTag(userId)
+	if !ok {
+		return "", false
+	}
+	sessionId := sh.GenerateSessionId()
+	if len(sessionId) <= CLUSTER_TAG_LEN {
+		return "", false
+	}
+	tagged := tag + sessionId[CLUSTER_TAG_LEN:]
+	generator := sh.IdGenerator
+	if generator == nil {
+		generator = base.NewRandomIdGenerator(base.DEFAULT_SESSION_ID_BYTES, base.Base64URLEncoding)
+	}
+	return tagged, generator.ValidId(tagged)
+}
+
+// inUserSlot returns true if the session Id already starts with the user's tag, or doesn't need to
+func (sh *SessionHolder) inUserSlot(sessionId, userId string) bool {
+	tag, ok := sh.userTag(userId)
+	return !ok || strings.HasPrefix(sessionId, tag)
 }
@@ -5,6 +5,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/philpearl/tt_goji_middleware/base"
 
 	redigo "github.com/garyburd/redigo/redis"
 	"github.com/zenazn/goji/web"
@@ -34,7 +37,7 @@ func TestSessionCreate(t *testing.T) {
 	sh.AddToResponse(c, s, w)
 
 	ch := w.HeaderMap.Get("Set-Cookie")
-	if ch != fmt.Sprintf("sessionid=%s; Path=/; Max-Age=%d", s.Id(), sh.GetTimeout()) {
+	if ch != fmt.Sprintf("sessionid=%s; Path=/; Max-Age=%d", s.Id(), sh.GetTimeout()+base.DEFAULT_EXPIRY_GRACE) {
 		t.Fatalf("cookie header is %v", ch)
 	}
 
@@ -64,3 +67,370 @@ func TestSessionCreate(t *testing.T) {
 	}
 
 }
+
+func TestSessionExpired(t *testing.T) {
+	conn, err := redigo.Dial("tcp", ":6379")
+	if err != nil {
+		t.Skipf("Cannot connect to redis. %v", err)
+	}
+	c := web.C{
+		Env: map[interface{}]interface{}{"redis": conn},
+	}
+	sh := NewSessionHolder().(*SessionHolder)
+	sh.SetTimeout(1)
+	sh.ExpiryGrace = 10
+
+	s := sh.Create(c)
+	err = sh.Save(c, s)
+	if err != nil {
+		t.Fatalf("failed to save session - %v", err)
+	}
+	defer sh.Destroy(c, s)
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{
+		Name:  "sessionid",
+		Value: s.Id(),
+	})
+
+	if _, err := sh.Get(c, r); err != nil {
+		t.Fatalf("got error reading session from request, %v", err)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	s1, err := sh.Get(c, r)
+	if err != base.ErrorSessionExpired {
+		t.Fatalf("expected session to have expired, got %v", err)
+	}
+	if s1 == nil || s1.Id() != s.Id() {
+		t.Fatalf("expected expired session to be returned")
+	}
+}
+
+func TestSessionExpiredDefaultGrace(t *testing.T) {
+	conn, err := redigo.Dial("tcp", ":6379")
+	if err != nil {
+		t.Skipf("Cannot connect to redis. %v", err)
+	}
+	c := web.C{
+		Env: map[interface{}]interface{}{"redis": conn},
+	}
+
+	// Expiry is reported without setting ExpiryGrace
+	for _, sh := range []base.SessionHolder{NewSessionHolder(), NewHashSessionHolder(base.BinaryCodec)} {
+		sh.SetTimeout(1)
+		s := sh.Create(c)
+		if err := sh.Save(c, s); err != nil {
+			t.Fatalf("failed to save session - %v", err)
+		}
+		defer sh.Destroy(c, s)
+
+		time.Sleep(1500 * time.Millisecond)
+
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "sessionid", Value: s.Id()})
+		if _, err := sh.Get(c, r); err != base.ErrorSessionExpired {
+			t.Fatalf("expected session to have expired, got %v", err)
+		}
+	}
+}
+
+func TestSessionLegacyLifetime(t *testing.T) {
+	conn, err := redigo.Dial("tcp", ":6379")
+	if err != nil {
+		t.Skipf("Cannot connect to redis. %v", err)
+	}
+	c := web.C{
+		Env: map[interface{}]interface{}{"redis": conn},
+	}
+	sh := NewSessionHolder().(*SessionHolder)
+	sh.SetMaxLifetime(60)
+
+	// A session stored before creation times were recorded
+	legacy := &base.Session{Values: map[string]interface{}{"cheese": "stilton"}}
+	data, err := base.EncodeSession(base.GobCodec, legacy)
+	if err != nil {
+		t.Fatalf("failed to encode session - %v", err)
+	}
+	id := sh.GenerateSessionId()
+	if _, err := conn.Do("SET", sh.sessionKey(id), data, "EX", 30); err != nil {
+		t.Fatalf("failed to store session - %v", err)
+	}
+	defer conn.Do("DEL", sh.sessionKey(id))
+
+	// Its lifetime starts when it is loaded, and is saved
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sessionid", Value: id})
+	s, err := sh.Get(c, r)
+	if err != nil {
+		t.Fatalf("failed to load session - %v", err)
+	}
+	if s.Created.IsZero() || !s.IsDirty() {
+		t.Fatalf("expected creation time to be set and saved, have %v, dirty %t", s.Created, s.IsDirty())
+	}
+	if err := sh.Save(c, s); err != nil {
+		t.Fatalf("failed to save session - %v", err)
+	}
+	s1, err := sh.Get(c, r)
+	if err != nil {
+		t.Fatalf("failed to load session - %v", err)
+	}
+	if !s1.Created.Equal(s.Created) || s1.IsDirty() {
+		t.Fatalf("creation time not saved, have %v expected %v", s1.Created, s.Created)
+	}
+	if ttl, err := redigo.Int(conn.Do("TTL", sh.sessionKey(id))); err != nil || ttl > 60+sh.ExpiryGrace {
+		t.Fatalf("session should be kept no longer than its lifetime, TTL %d %v", ttl, err)
+	}
+}
+
+func TestUserSessions(t *testing.T) {
+	conn, err := redigo.Dial("tcp", ":6379")
+	if err != nil {
+		t.Skipf("Cannot connect to redis. %v", err)
+	}
+	c := web.C{
+		Env: map[interface{}]interface{}{"redis": conn},
+	}
+	sh := NewSessionHolder()
+	index := sh.(base.UserSessionIndex)
+	userId := fmt.Sprintf("wallace-%d", time.Now().UnixNano())
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "cheese-browser/1.0")
+
+	s1 := sh.Create(c)
+	if err := index.BindUser(c, r, s1, userId); err != nil {
+		t.Fatalf("failed to bind user - %v", err)
+	}
+	s2 := sh.Create(c)
+	if err := index.BindUser(c, r, s2, userId); err != nil {
+		t.Fatalf("failed to bind user - %v", err)
+	}
+	if _, err := sh.RegenerateId(c, s2); err != nil {
+		t.Fatalf("failed to regenerate id - %v", err)
+	}
+
+	infos, err := index.UserSessions(c, userId)
+	if err != nil {
+		t.Fatalf("failed to list sessions - %v", err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 sessions, have %v", infos)
+	}
+	for _, info := range infos {
+		if info.Id != s1.Id() && info.Id != s2.Id() {
+			t.Fatalf("unexpected session %v", info)
+		}
+		if info.UserAgent != "cheese-browser/1.0" {
+			t.Fatalf("user agent not the cheese we were hoping for, %v", info)
+		}
+	}
+
+	if err := index.DestroyUserSessions(c, userId); err != nil {
+		t.Fatalf("failed to destroy sessions - %v", err)
+	}
+	for _, s := range []*base.Session{s1, s2} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "sessionid", Value: s.Id()})
+		if _, err := sh.Get(c, r); err != base.ErrorSessionNotFound {
+			t.Fatalf("session should be destroyed, have %v", err)
+		}
+	}
+}
+
+func TestSessionCodecs(t *testing.T) {
+	conn, err := redigo.Dial("tcp", ":6379")
+	if err != nil {
+		t.Skipf("Cannot connect to redis. %v", err)
+	}
+	c := web.C{
+		Env: map[interface{}]interface{}{"redis": conn},
+	}
+	jsh := NewSessionHolderWithCodec(base.JSONCodec)
+	sh := NewSessionHolder()
+
+	s := jsh.Create(c)
+	s.Put("cheese", "camembert")
+	if err := jsh.Save(c, s); err != nil {
+		t.Fatalf("failed to save session - %v", err)
+	}
+	defer jsh.Destroy(c, s)
+
+	data, err := redigo.Bytes(conn.Do("GET", jsh.(*SessionHolder).sessionKey(s.Id())))
+	if err != nil {
+		t.Fatalf("failed to read session - %v", err)
+	}
+	if data[0] != base.CODEC_JSON || data[1] != '{' {
+		t.Fatalf("session not stored as JSON, %q", data)
+	}
+
+	// A holder using a different codec can still read the session
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sessionid", Value: s.Id()})
+	s1, err := sh.Get(c, r)
+	if err != nil {
+		t.Fatalf("got error reading session, %v", err)
+	}
+	if cheese, _ := s1.Get("cheese"); cheese != "camembert" {
+		t.Fatalf("cheese is %v", cheese)
+	}
+}
+
+func TestSessionConflict(t *testing.T) {
+	conn, err := redigo.Dial("tcp", ":6379")
+	if err != nil {
+		t.Skipf("Cannot connect to redis. %v", err)
+	}
+	c := web.C{
+		Env: map[interface{}]interface{}{"redis": conn},
+	}
+
+	for _, sh := range []base.SessionHolder{NewSessionHolder(), NewHashSessionHolder(base.BinaryCodec)} {
+		s := sh.Create(c)
+		s.Put("cheese", "cheddar")
+		if err := sh.Save(c, s); err != nil {
+			t.Fatalf("failed to save session - %v", err)
+		}
+
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "sessionid", Value: s.Id()})
+		s1, err := sh.Get(c, r)
+		if err != nil {
+			t.Fatalf("got error reading session, %v", err)
+		}
+		s2, err := sh.Get(c, r)
+		if err != nil {
+			t.Fatalf("got error reading session, %v", err)
+		}
+
+		// Sessions saved whole conflict with saves since they were loaded
+		s1.Put("cheese", "brie")
+		s1.SetDirty(true)
+		if err := sh.Save(c, s1); err != nil {
+			t.Fatalf("failed to save session - %v", err)
+		}
+		s2.Put("cheese", "edam")
+		s2.SetDirty(true)
+		if err := sh.Save(c, s2); err != base.ErrorSessionConflict {
+			t.Fatalf("expected ErrorSessionConflict, have %v", err)
+		}
+		if err := sh.Save(c, s1); err != nil {
+			t.Fatalf("saving again should not conflict - %v", err)
+		}
+
+		s3, err := sh.Get(c, r)
+		if err != nil {
+			t.Fatalf("got error reading session, %v", err)
+		}
+		if cheese, _ := s3.Get("cheese"); cheese != "brie" {
+			t.Fatalf("cheese is %v", cheese)
+		}
+
+		// A request that loaded the session before it was revoked can't bring it back
+		s4, err := sh.Get(c, r)
+		if err != nil {
+			t.Fatalf("got error reading session, %v", err)
+		}
+		sh.Destroy(c, s3)
+		s4.Put("cheese", "stilton")
+		s4.SetDirty(true)
+		if err := sh.Save(c, s4); err != base.ErrorSessionNotFound {
+			t.Fatalf("expected ErrorSessionNotFound saving revoked session, have %v", err)
+		}
+		if _, err := sh.Get(c, r); err != base.ErrorSessionNotFound {
+			t.Fatalf("session should stay revoked, have %v", err)
+		}
+	}
+}
+
+func TestClusterSessionHolder(t *testing.T) {
+	conn, err := redigo.Dial("tcp", ":6379")
+	if err != nil {
+		t.Skipf("Cannot connect to redis. %v", err)
+	}
+	c := web.C{
+		Env: map[interface{}]interface{}{"redis": conn},
+	}
+	sh := NewSessionHolder().(*SessionHolder)
+	sh.Cluster = true
+	sh.UserTagKey = []byte("a secret known only to the cheese shop")
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	s := sh.Create(c)
+	s.Put("cheese", "wensleydale")
+	if err := sh.BindUser(c, r, s, "wallace"); err != nil {
+		t.Fatalf("failed to bind user - %v", err)
+	}
+	if KeySlot(sh.sessionKey(s.Id())) != KeySlot(sh.userSessionsKey("wallace")) {
+		t.Fatalf("session not in the same slot as the user's set")
+	}
+
+	// Renaming keeps the session in the user's slot
+	oldId := s.Id()
+	if _, err := sh.RegenerateId(c, s); err != nil {
+		t.Fatalf("failed to regenerate id - %v", err)
+	}
+	if KeySlot(sh.sessionKey(s.Id())) != KeySlot(sh.userSessionsKey("wallace")) {
+		t.Fatalf("regenerated session not in the same slot as the user's set")
+	}
+	r.AddCookie(&http.Cookie{Name: "sessionid", Value: s.Id()})
+	s1, err := sh.Get(c, r)
+	if err != nil {
+		t.Fatalf("got error reading session, %v", err)
+	}
+	if cheese, _ := s1.Get("cheese"); cheese != "wensleydale" {
+		t.Fatalf("cheese is %v", cheese)
+	}
+	if exists, _ := redigo.Bool(conn.Do("EXISTS", sh.sessionKey(oldId))); exists {
+		t.Fatalf("old session key should be deleted")
+	}
+
+	infos, err := sh.UserSessions(c, "wallace")
+	if err != nil || len(infos) != 1 || infos[0].Id != s.Id() {
+		t.Fatalf("user sessions are %v, %v", infos, err)
+	}
+	if err := sh.DestroyUserSessions(c, "wallace"); err != nil {
+		t.Fatalf("failed to destroy sessions - %v", err)
+	}
+	if _, err := sh.Get(c, r); err != base.ErrorSessionNotFound {
+		t.Fatalf("session should be destroyed, have %v", err)
+	}
+}
+
+func TestClusterSessionIds(t *testing.T) {
+	for _, encoding := range []base.IdEncoding{base.Base64URLEncoding, base.HexEncoding} {
+		sh := NewSessionHolder().(*SessionHolder)
+		sh.Cluster = true
+		sh.IdGenerator = base.NewRandomIdGenerator(base.DEFAULT_SESSION_ID_BYTES, encoding)
+
+		// Without a key sessions aren't tagged with their user
+		if _, ok := sh.generateUserSessionId("gromit"); ok {
+			t.Fatalf("session id tagged without a key")
+		}
+		if !sh.inUserSlot(sh.GenerateSessionId(), "gromit") {
+			t.Fatalf("session should not need moving without a key")
+		}
+
+		sh.UserTagKey = []byte("a secret known only to the cheese shop")
+		sessionId, ok := sh.generateUserSessionId("gromit")
+		if !ok {
+			t.Fatalf("could not generate a session id for the user")
+		}
+		if !sh.IdGenerator.ValidId(sessionId) {
+			t.Fatalf("session id %s is not valid", sessionId)
+		}
+		if KeySlot(sh.sessionKey(sessionId)) != KeySlot(sh.userSessionsKey("gromit")) {
+			t.Fatalf("session not in the same slot as the user's set")
+		}
+		if !sh.inUserSlot(sessionId, "gromit") || sh.inUserSlot(sh.GenerateSessionId(), "gromit") {
+			t.Fatalf("inUserSlot is wrong")
+		}
+
+		// The tag can't be worked out from the user Id without the key
+		sh.UserTagKey = []byte("another secret")
+		if sh.inUserSlot(sessionId, "gromit") {
+			t.Fatalf("user tag doesn't depend on the key")
+		}
+	}
+}
@@ -2,7 +2,6 @@ package redis
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 	"time"
@@ -37,6 +36,37 @@ Example
 
 */
 func BuildThrottleMiddleWare(interval int, keyfunc Keyfunc) func(c *web.C, h http.Handler) http.Handler {
+	return BuildThrottleMiddleWareWithOptions(interval, keyfunc, ThrottleOptions{})
+}
+
+/*
+ThrottleOptions controls the throttling middleware built by BuildThrottleMiddleWareWithOptions
+*/
+type ThrottleOptions struct {
+	// Namespace, if set, prefixes the keys returned by the Keyfunc.  See NamespacedKey
+	Namespace string
+	// Algorithm chooses how requests are counted.  Defaults to FIXED_WINDOW.  The local limiter
+	// used by FAIL_LOCAL always uses fixed windows
+	Algorithm ThrottleAlgorithm
+
+	// OnFailure says what to do when redis can't be used.  Defaults to FAIL_CLOSED
+	OnFailure ThrottleFailurePolicy
+	// OnError is called whenever redis can't be used, for example to record a metric.  err is
+	// ErrorCircuitOpen when redis isn't tried because of earlier failures.  Defaults to logging
+	// the error
+	OnError func(c *web.C, r *http.Request, err error)
+	// After BreakerThreshold consecutive failures redis isn't tried for BreakerCooldown.  Defaults
+	// to DEFAULT_BREAKER_THRESHOLD and DEFAULT_BREAKER_COOLDOWN.  Only failures to reach redis
+	// count: error replies such as WRONGTYPE are passed to OnError but don't open the breaker
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+/*
+BuildThrottleMiddleWareWithOptions creates throttling middleware like BuildThrottleMiddleWare, with
+options
+*/
+func BuildThrottleMiddleWareWithOptions(interval int, keyfunc Keyfunc, opts ThrottleOptions) func(c *web.C, h http.Handler) http.Handler {
 
 	// Script increments the key, and sets expiry to "interval" seconds if the value is 1
 	var redisThrottleScript = redigo.NewScript(
@@ -47,20 +77,63 @@ func BuildThrottleMiddleWare(interval int, keyfunc Keyfunc) func(c *web.C, h htt
 		),
 	)
 
+	onError := opts.OnError
+	if onError == nil {
+		onError = logThrottleError
+	}
+	breaker := newBreaker(opts.BreakerThreshold, opts.BreakerCooldown)
+	local := newLocalLimiter(time.Duration(interval) * time.Second)
+
+	// hit counts a request in redis, returning the number of requests on this key in this period,
+	// and the TTL of this period
+	hit := func(c *web.C, key string, limit int) (int, int64, error) {
+		if !breaker.allow() {
+			return 0, 0, ErrorCircuitOpen
+		}
+		redis_conn, ok := c.Env["redis"].(redigo.Conn)
+		if !ok {
+			breaker.done(ErrorNoRedisConn)
+			return 0, 0, ErrorNoRedisConn
+		}
+		var rsp []int64
+		var err error
+		switch opts.Algorithm {
+		case SLIDING_WINDOW_LOG:
+			rsp, err = redigo.Int64s(slidingLogScript.Do(redis_conn, key, interval, limit, uniqueMember()))
+		case SLIDING_WINDOW_COUNTER:
+			rsp, err = redigo.Int64s(slidingCounterScript.Do(redis_conn, key, interval, limit))
+		default:
+			rsp, err = redigo.Int64s(redisThrottleScript.Do(redis_conn, key))
+		}
+		breaker.done(breakerError(redis_conn, err))
+		if err != nil {
+			return 0, 0, err
+		}
+		return int(rsp[0]), rsp[1], nil
+	}
+
 	return func(c *web.C, h http.Handler) http.Handler {
 		handler := func(w http.ResponseWriter, r *http.Request) {
 			// Get a throttle key that identifies this flow
 			throttleKey, limit := keyfunc(c, r)
 			if limit > 0 {
-				redis_conn := c.Env["redis"].(redigo.Conn)
-				// Returns number of requests on this key in this period, and TTL of this period
-				rsp, err := redigo.Values(redisThrottleScript.Do(redis_conn, throttleKey))
+				throttleKey = NamespacedKey(opts.Namespace, throttleKey)
+				numRequests, ttl, err := hit(c, throttleKey, limit)
 				if err != nil {
-					log.Printf("Throttling: Cache failure, %v", err)
-					http.Error(w, fmt.Sprintf("Throttling: Cache failure, %v", err), http.StatusServiceUnavailable)
+					onError(c, r, err)
+					switch opts.OnFailure {
+					case FAIL_OPEN:
+						h.ServeHTTP(w, r)
+						return
+					case FAIL_LOCAL:
+						var reset time.Time
+						numRequests, reset = local.hit(throttleKey)
+						ttl = int64(time.Until(reset) / time.Second)
+					default:
+						http.Error(w, fmt.Sprintf("Throttling: Cache failure, %v", err), http.StatusServiceUnavailable)
+						return
+					}
 				}
-				numRequests := int(rsp[0].(int64))
-				ttl := rsp[1].(int64)
 
 				h := w.Header()
 				setHeaderInt(h, "X-RateLimit-Limit", limit)
@@ -76,8 +76,203 @@ func TestThrottle(t *testing.T) {
 	f(10, -1, 429)
 }
 
+func TestThrottleAlgorithms(t *testing.T) {
+	conn, err := redigo.Dial("tcp", ":6379")
+	if err != nil {
+		t.Skipf("Cannot connect to redis. %v", err)
+	}
+	defer conn.Close()
+	c := &web.C{Env: map[interface{}]interface{}{"redis": conn}}
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	r, _ := http.NewRequest("GET", "http://example.com/cheese", nil)
+
+	for _, algorithm := range []ThrottleAlgorithm{SLIDING_WINDOW_LOG, SLIDING_WINDOW_COUNTER} {
+		key := "testthr:algorithm:" + strconv.Itoa(int(algorithm))
+		if _, err := conn.Do("DEL", key); err != nil {
+			t.Fatalf("failed to clear %s - %v", key, err)
+		}
+		m := BuildThrottleMiddleWareWithOptions(10, func(c *web.C, r *http.Request) (string, int) {
+			return key, 3
+		}, ThrottleOptions{Algorithm: algorithm})
+
+		start := int(time.Now().Unix())
+		for i, expCode := range []int{200, 200, 200, 429, 429} {
+			w := httptest.NewRecorder()
+			m(c, h).ServeHTTP(w, r)
+			if w.Code != expCode {
+				t.Fatalf("algorithm %d request %d: expected %d, have %d", algorithm, i, expCode, w.Code)
+			}
+			remaining := getHeaderInt(w.HeaderMap, "X-RateLimit-Remaining")
+			if expRem := 2 - i; expRem >= 0 && remaining != expRem {
+				t.Fatalf("algorithm %d request %d: X-RateLimit-Remaining expected %d was %d", algorithm, i, expRem, remaining)
+			}
+			reset := getHeaderInt(w.HeaderMap, "X-RateLimit-Reset")
+			if reset < start || reset > start+11 {
+				t.Fatalf("algorithm %d: reset a bit funny.  Value is %d, start is %d", algorithm, reset, start)
+			}
+		}
+	}
+
+	// Rejected requests aren't logged, so the log holds only the allowed ones
+	if n, err := redigo.Int(conn.Do("ZCARD", "testthr:algorithm:"+strconv.Itoa(int(SLIDING_WINDOW_LOG)))); err != nil || n != 3 {
+		t.Fatalf("expected 3 entries in the log, have %d, %v", n, err)
+	}
+}
+
 func getHeaderInt(h http.Header, key string) int {
 	strval := h.Get(key)
 	val, _ := strconv.Atoi(strval)
 	return val
 }
+
+func TestThrottleFailure(t *testing.T) {
+	f := startFakeRedis(t, func(args []string) string {
+		return "-ERR the cheese shop is closed\r\n"
+	})
+	defer f.Close()
+	conn, err := redigo.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect - %v", err)
+	}
+	defer conn.Close()
+
+	var errs []error
+	var called int
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called++
+	})
+	request := func(opts ThrottleOptions) int {
+		opts.OnError = func(c *web.C, r *http.Request, err error) {
+			errs = append(errs, err)
+		}
+		m := BuildThrottleMiddleWareWithOptions(10, func(c *web.C, r *http.Request) (string, int) {
+			return "cheesethr", 2
+		}, opts)
+		c := &web.C{Env: map[interface{}]interface{}{"redis": conn}}
+		r, _ := http.NewRequest("GET", "http://example.com/foo", nil)
+		w := httptest.NewRecorder()
+		m(c, h).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Fail closed by default, without calling the handler
+	if code := request(ThrottleOptions{}); code != http.StatusServiceUnavailable || called != 0 || len(errs) != 1 {
+		t.Fatalf("expected 503 without calling handler, have %d, %d calls, errors %v", code, called, errs)
+	}
+
+	if code := request(ThrottleOptions{OnFailure: FAIL_OPEN}); code != http.StatusOK || called != 1 || len(errs) != 2 {
+		t.Fatalf("expected request to be allowed, have %d, %d calls, errors %v", code, called, errs)
+	}
+
+	// The local limiter takes over, and redis isn't tried once the breaker opens.  A reply that
+	// isn't redis protocol breaks the connection
+	broken := startFakeRedis(t, func(args []string) string {
+		return "cheese\r\n"
+	})
+	defer broken.Close()
+	errs = nil
+	m := BuildThrottleMiddleWareWithOptions(10, func(c *web.C, r *http.Request) (string, int) {
+		return "cheesethr", 2
+	}, ThrottleOptions{
+		OnFailure:        FAIL_LOCAL,
+		BreakerThreshold: 2,
+		OnError: func(c *web.C, r *http.Request, err error) {
+			errs = append(errs, err)
+		},
+	})
+	for i, expected := range []int{http.StatusOK, http.StatusOK, 429, 429} {
+		conn, err := redigo.Dial("tcp", broken.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect - %v", err)
+		}
+		defer conn.Close()
+		c := &web.C{Env: map[interface{}]interface{}{"redis": conn}}
+		r, _ := http.NewRequest("GET", "http://example.com/foo", nil)
+		w := httptest.NewRecorder()
+		m(c, h).ServeHTTP(w, r)
+		if w.Code != expected {
+			t.Fatalf("request %d: expected %d, have %d", i, expected, w.Code)
+		}
+		if remaining := getHeaderInt(w.HeaderMap, "X-RateLimit-Remaining"); remaining != 1-i {
+			t.Fatalf("request %d: X-RateLimit-Remaining is %d", i, remaining)
+		}
+	}
+	if n := len(broken.received()); n != 2 {
+		t.Fatalf("expected 2 commands sent to redis, have %d", n)
+	}
+	if len(errs) != 4 || errs[2] != ErrorCircuitOpen || errs[3] != ErrorCircuitOpen {
+		t.Fatalf("errors are %v", errs)
+	}
+}
+
+func TestThrottleReplyErrors(t *testing.T) {
+	f := startFakeRedis(t, func(args []string) string {
+		return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	})
+	defer f.Close()
+	conn, err := redigo.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect - %v", err)
+	}
+	defer conn.Close()
+
+	// Error replies show redis is up, so they don't open the breaker
+	var errs []error
+	onError := func(c *web.C, r *http.Request, err error) {
+		errs = append(errs, err)
+	}
+	throttle := BuildThrottleMiddleWareWithOptions(10, func(c *web.C, r *http.Request) (string, int) {
+		return "cheesethr", 10
+	}, ThrottleOptions{OnFailure: FAIL_OPEN, BreakerThreshold: 2, OnError: onError})
+	limiter, _ := NewGCRALimiter(10, time.Minute, 10)
+	gcra := BuildGCRAMiddleWare(limiter, func(c *web.C, r *http.Request) string {
+		return "cheesegcra"
+	}, ThrottleOptions{OnFailure: FAIL_OPEN, BreakerThreshold: 2, OnError: onError})
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, m := range []func(c *web.C, h http.Handler) http.Handler{throttle, gcra} {
+		for i := 0; i < 4; i++ {
+			c := &web.C{Env: map[interface{}]interface{}{"redis": conn}}
+			r, _ := http.NewRequest("GET", "http://example.com/foo", nil)
+			m(c, h).ServeHTTP(httptest.NewRecorder(), r)
+		}
+	}
+	if n := len(f.received()); n != 8 {
+		t.Fatalf("expected 8 commands sent to redis, have %d", n)
+	}
+	if len(errs) != 8 {
+		t.Fatalf("expected 8 errors, have %v", errs)
+	}
+	for _, err := range errs {
+		if err == ErrorCircuitOpen {
+			t.Fatalf("breaker opened on error replies, errors are %v", errs)
+		}
+	}
+}
+
+func TestThrottleBreaker(t *testing.T) {
+	b := newBreaker(1, 10*time.Millisecond)
+	if !b.allow() {
+		t.Fatalf("breaker should start closed")
+	}
+	b.done(ErrorNoRedisConn)
+	if b.allow() {
+		t.Fatalf("breaker should open after failure")
+	}
+
+	// After the cooldown a single request tries again
+	time.Sleep(20 * time.Millisecond)
+	if !b.allow() {
+		t.Fatalf("breaker should allow a trial after cooldown")
+	}
+	if b.allow() {
+		t.Fatalf("breaker should allow only one trial")
+	}
+	b.done(nil)
+	if !b.allow() || !b.allow() {
+		t.Fatalf("breaker should close after a successful trial")
+	}
+}
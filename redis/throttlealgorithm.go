@@ -0,0 +1,103 @@
+package redis
+
+import (
+	"math/rand"
+	"strconv"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+/*
+ThrottleAlgorithm chooses how the throttling middleware counts requests
+*/
+type ThrottleAlgorithm int
+
+const (
+	// Count requests in fixed windows of the interval.  This needs the least work from redis, but
+	// a client can make twice the limit of requests across the end of one window and the start
+	// of the next.  This is the default.  Rejected requests are counted
+	FIXED_WINDOW ThrottleAlgorithm = iota
+	// Keep a log of the time of each request in a sorted set, and count those in the last
+	// interval.  This is exact, but stores an entry for every request allowed
+	SLIDING_WINDOW_LOG
+	// Estimate the requests in the last interval from counts for the current and previous fixed
+	// windows, assuming the previous window's requests were evenly spread.  This stores just
+	// two counts per key
+	SLIDING_WINDOW_COUNTER
+)
+
+/*
+slidingLogScript counts requests in the last interval using a sorted set of request times.
+
+KEYS[1] is the throttle key.  ARGV[1] is the interval in seconds, ARGV[2] the limit and ARGV[3] a
+random string to make this request's entry unique.  Requests over the limit are not logged, so
+clients that keep retrying are let through again once their earlier requests leave the window.
+
+Returns the number of requests in the window including this one, and the seconds until the
+oldest leaves the window.  Times come from the redis server so all clients agree.
+*/
+var slidingLogScript = redigo.NewScript(1, `
+if redis.replicate_commands then redis.replicate_commands() end
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local window = tonumber(ARGV[1]) * 1000
+local limit = tonumber(ARGV[2])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', string.format('(%d', now - window))
+local count = redis.call('ZCARD', KEYS[1])
+if count < limit then
+	redis.call('ZADD', KEYS[1], string.format('%d', now), string.format('%d:%s', now, ARGV[3]))
+	redis.call('PEXPIRE', KEYS[1], string.format('%d', window))
+end
+
+local ttl = window
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+if #oldest == 2 then
+	ttl = tonumber(oldest[2]) + window - now
+end
+return {count + 1, math.ceil(ttl / 1000)}
+`)
+
+/*
+slidingCounterScript estimates the requests in the last interval from the counts for the current
+and previous fixed windows, kept in a hash with the number of the current window.
+
+KEYS[1] is the throttle key.  ARGV[1] is the interval in seconds and ARGV[2] the limit.  Requests
+over the limit are not counted.
+
+Returns the estimated number of requests in the window including this one, and the seconds until
+the current fixed window ends.
+*/
+var slidingCounterScript = redigo.NewScript(1, `
+if redis.replicate_commands then redis.replicate_commands() end
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local window = tonumber(ARGV[1]) * 1000
+local limit = tonumber(ARGV[2])
+local current = math.floor(now / window)
+
+local data = redis.call('HMGET', KEYS[1], 'window', 'current', 'previous')
+local stored = tonumber(data[1])
+local cur = tonumber(data[2]) or 0
+local prev = tonumber(data[3]) or 0
+if stored == current - 1 then
+	prev, cur = cur, 0
+elseif stored ~= current then
+	prev, cur = 0, 0
+end
+
+local elapsed = (now - current * window) / window
+local count = math.floor(prev * (1 - elapsed)) + cur
+if count < limit then
+	cur = cur + 1
+end
+redis.call('HMSET', KEYS[1], 'window', string.format('%d', current), 'current', cur, 'previous', prev)
+redis.call('PEXPIRE', KEYS[1], string.format('%d', 2 * window))
+
+return {count + 1, math.ceil(((current + 1) * window - now) / 1000)}
+`)
+
+// uniqueMember makes entries in the sliding log unique when requests arrive in the same millisecond
+func uniqueMember() string {
+	return strconv.FormatInt(rand.Int63(), 36)
+}
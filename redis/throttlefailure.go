@@ -0,0 +1,153 @@
+package redis
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/zenazn/goji/web"
+)
+
+/*
+ThrottleFailurePolicy says what the throttling middleware does when it can't use redis
+*/
+type ThrottleFailurePolicy int
+
+const (
+	// Respond with 503 Service Unavailable and don't call the handler.  This is the default
+	FAIL_CLOSED ThrottleFailurePolicy = iota
+	// Call the handler without throttling the request
+	FAIL_OPEN
+	// Throttle the request with a limiter in this process.  Each instance of the application
+	// applies the limit separately, so more requests are allowed in total
+	FAIL_LOCAL
+)
+
+const (
+	// Consecutive redis failures after which the throttle stops trying redis for a while
+	DEFAULT_BREAKER_THRESHOLD = 5
+	// How long the throttle stops trying redis for
+	DEFAULT_BREAKER_COOLDOWN = 10 * time.Second
+)
+
+var (
+	ErrorCircuitOpen error = errors.New("throttle is not using redis after repeated failures")
+	ErrorNoRedisConn error = errors.New("no redis connection in c.Env[\"redis\"]")
+)
+
+/*
+logThrottleError is the default for ThrottleOptions.OnError
+*/
+func logThrottleError(c *web.C, r *http.Request, err error) {
+	log.Printf("Throttling: Cache failure, %v", err)
+}
+
+/*
+breaker is a circuit breaker.  After threshold consecutive failures it opens, and requests don't
+try redis until cooldown has passed.  Then a single request tries it: if that works the breaker
+closes, otherwise it stays open for another cooldown.
+*/
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trying    bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	if threshold <= 0 {
+		threshold = DEFAULT_BREAKER_THRESHOLD
+	}
+	if cooldown <= 0 {
+		cooldown = DEFAULT_BREAKER_COOLDOWN
+	}
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns true if this request should try redis.  Call done with the result if it does
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.trying || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.trying = true
+	return true
+}
+
+func (b *breaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trying = false
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// breakerError returns err if it means redis failed, for breaker.done.  Error replies such as
+// WRONGTYPE or a script error show redis is up, so return nil unless the connection broke too
+func breakerError(conn redigo.Conn, err error) error {
+	if _, ok := err.(redigo.Error); ok && conn.Err() == nil {
+		return nil
+	}
+	return err
+}
+
+/*
+localLimiter counts requests in fixed windows in memory, for when redis is unavailable
+*/
+type localLimiter struct {
+	interval time.Duration
+
+	mu        sync.Mutex
+	windows   map[string]*localWindow
+	lastSweep time.Time
+}
+
+type localWindow struct {
+	count int
+	reset time.Time
+}
+
+func newLocalLimiter(interval time.Duration) *localLimiter {
+	return &localLimiter{interval: interval, windows: map[string]*localWindow{}}
+}
+
+// hit counts a request for key and returns the count in this window and the time the window ends
+func (l *localLimiter) hit(key string) (int, time.Time) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget finished windows now and then, so keys that are no longer used don't build up
+	if now.Sub(l.lastSweep) > l.interval {
+		for k, w := range l.windows {
+			if !now.Before(w.reset) {
+				delete(l.windows, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	w, ok := l.windows[key]
+	if !ok || !now.Before(w.reset) {
+		w = &localWindow{reset: now.Add(l.interval)}
+		l.windows[key] = w
+	}
+	w.count++
+	return w.count, w.reset
+}